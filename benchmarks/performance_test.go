@@ -17,7 +17,7 @@ func setupShardedDB(basePath string, numShards int, keysPerShard int) (*keystore
 		return nil, err
 	}
 
-	skv, err := keystore.NewShardedKV(basePath, numShards)
+	skv, err := keystore.NewShardedKV(basePath, numShards, keystore.DefaultOptions())
 	if err != nil {
 		return nil, err
 	}
@@ -61,8 +61,8 @@ func BenchmarkShardedReads(b *testing.B) {
 			for range ch {
 				idx := rand.Intn(numShards * keysPerShard)
 				key := "key" + strconv.Itoa(idx)
-				if _, ok := skv.Get(key); !ok {
-					b.Errorf("Get failed for key %s", key)
+				if _, ok, err := skv.Get(key); err != nil || !ok {
+					b.Errorf("Get failed for key %s: %v", key, err)
 				}
 			}
 		}()
@@ -149,7 +149,7 @@ func BenchmarkShardedCompaction(b *testing.B) {
 
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		if err := skv.Compact(basePath); err != nil {
+		if err := skv.Compact(); err != nil {
 			b.Errorf("Compaction failed: %v", err)
 		}
 	}
@@ -10,7 +10,7 @@ import (
 )
 
 func BenchmarkMiniKVLoad(b *testing.B) {
-	db, err := keystore.NewShardedKV("testshards", 8)
+	db, err := keystore.NewShardedKV("testshards", 8, keystore.DefaultOptions())
 	if err != nil {
 		b.Fatal(err)
 	}
@@ -1,9 +1,83 @@
 package main
 
 import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	miniondb "github.com/Aswin-Sk/MinionDB"
 	"github.com/Aswin-Sk/MinionDB/pkg/app"
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "upgrade":
+			os.Exit(upgrade(os.Args[2:]))
+		case "restore":
+			os.Exit(restore(os.Args[2:]))
+		}
+	}
 	app.Start()
 }
+
+// upgrade rewrites a legacy data directory, "data" by default, into the
+// current file format.
+func upgrade(args []string) int {
+	dir := "data"
+	switch len(args) {
+	case 0:
+	case 1:
+		dir = args[0]
+	default:
+		fmt.Fprintln(os.Stderr, "usage: miniondb upgrade [dir]")
+		return 2
+	}
+	upgraded, err := miniondb.Upgrade(dir)
+	for _, p := range upgraded {
+		fmt.Println("upgraded", p)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "upgrade failed:", err)
+		return 1
+	}
+	fmt.Printf("%d files upgraded\n", len(upgraded))
+	return 0
+}
+
+const restoreUsage = "usage: miniondb restore --checkpoint dir --archive dir (--until-seq n | --until-time RFC3339) target"
+
+// restore builds a data directory at target from a checkpoint and the WAL
+// segments archived since, as of the chosen sequence number or time.
+func restore(args []string) int {
+	fs := flag.NewFlagSet("restore", flag.ContinueOnError)
+	fs.Usage = func() { fmt.Fprintln(os.Stderr, restoreUsage) }
+	checkpoint := fs.String("checkpoint", "", "checkpoint directory written by DB.Checkpoint")
+	archive := fs.String("archive", "", "WAL archive directory")
+	untilSeq := fs.Uint64("until-seq", 0, "last sequence number to restore")
+	untilTime := fs.String("until-time", "", "restore writes made up to this RFC 3339 time")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *checkpoint == "" || *archive == "" || fs.NArg() != 1 || (*untilSeq == 0) == (*untilTime == "") {
+		fs.Usage()
+		return 2
+	}
+	to := miniondb.RestorePoint{Seq: *untilSeq}
+	if *untilTime != "" {
+		t, err := time.Parse(time.RFC3339Nano, *untilTime)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "restore: bad --until-time:", err)
+			return 2
+		}
+		to.Time = t
+	}
+	target := fs.Arg(0)
+	if err := miniondb.Restore(*checkpoint, *archive, target, to); err != nil {
+		fmt.Fprintln(os.Stderr, "restore failed:", err)
+		return 1
+	}
+	fmt.Println("restored", target)
+	return 0
+}
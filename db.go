@@ -1,22 +1,230 @@
 package miniondb
 
 import (
+	"context"
 	"errors"
 	"log/slog"
+	"time"
 
+	"github.com/Aswin-Sk/MinionDB/internal/SSTables"
+	"github.com/Aswin-Sk/MinionDB/internal/fileformat"
 	"github.com/Aswin-Sk/MinionDB/internal/keystore"
 	"github.com/Aswin-Sk/MinionDB/internal/logger"
 )
 
+// ErrCorruption is matched by errors.Is for any error caused by damaged
+// on-disk data. Use errors.As with *CorruptionError for the file and offset.
+var ErrCorruption = SSTables.ErrCorruption
+
+type CorruptionError = SSTables.CorruptionError
+
+var (
+	// ErrLegacyFormat is matched by errors.Is when Open finds files written
+	// before format versioning. Convert them with Upgrade.
+	ErrLegacyFormat = fileformat.ErrLegacyFormat
+	// ErrUnsupportedVersion is matched by errors.Is when a file was written
+	// in a format version this build cannot read.
+	ErrUnsupportedVersion = fileformat.ErrUnsupportedVersion
+	// ErrDegraded is matched by errors.Is for the error every write returns
+	// once a WAL write or sync has failed. The DB serves reads but refuses
+	// writes until it is closed and reopened.
+	ErrDegraded = keystore.ErrDegraded
+	// ErrTrimmed is returned by Subscribe when writes it was asked to replay
+	// are no longer retained. See Options.WALRetention.
+	ErrTrimmed = keystore.ErrTrimmed
+	// ErrLagged ends a subscription whose reader fell too far behind.
+	// Subscribe again from the sequence number after the last event seen.
+	ErrLagged = keystore.ErrLagged
+	// ErrCheckpointTooNew is returned by Restore when the checkpoint was
+	// taken after the restore point.
+	ErrCheckpointTooNew = keystore.ErrCheckpointTooNew
+	// ErrBusy is returned by SetCtx and DeleteCtx when the shard's WAL
+	// queue is full. The write was not applied and can be retried.
+	ErrBusy = keystore.ErrBusy
+)
+
+type DegradedError = keystore.DegradedError
+
+// ReadOptions controls a single read. Start from DefaultReadOptions.
+type ReadOptions = SSTables.ReadOptions
+
+// CacheStats reports the block cache's hit, miss and eviction counts and
+// its size in bytes.
+type CacheStats = SSTables.CacheStats
+
+// DefaultReadOptions returns the options used by Get.
+func DefaultReadOptions() ReadOptions {
+	return SSTables.DefaultReadOptions()
+}
+
 type DB struct {
 	skv *keystore.ShardedKV
 }
 
+// Options tunes the storage engine. The zero value is not useful; start
+// from DefaultOptions.
+type Options struct {
+	// BloomFalsePositiveRate is the target false-positive rate of the Bloom
+	// filter stored in every SSTable. Lower rates cost more memory per key;
+	// zero disables the filters.
+	BloomFalsePositiveRate float64
+	// Compression selects the codec for SSTable data blocks written from
+	// now on. Existing tables keep the codec they were written with.
+	Compression Compression
+	// MaxOpenFiles bounds the SSTable files kept open for reads across all
+	// shards. Least recently used files are closed first.
+	MaxOpenFiles int
+	// Mmap memory-maps SSTable files instead of reading them with
+	// syscalls. It is ignored on platforms without mmap.
+	Mmap bool
+	// BlockCacheSize is the number of bytes of SSTable blocks kept in
+	// memory, shared by all shards. Zero disables the cache.
+	BlockCacheSize int64
+	// WALRecovery decides what Open does with damaged WAL records.
+	WALRecovery WALRecoveryMode
+	// Durability decides when acknowledged writes reach stable storage.
+	// Under SyncInterval, SyncInterval bounds how long they may not.
+	Durability   Durability
+	SyncInterval time.Duration
+	// WALBatchSize is the most writes grouped into one WAL write, and
+	// WALBatchInterval the longest a write waits for its group to fill.
+	WALBatchSize     int
+	WALBatchInterval time.Duration
+	// WALSegmentSize is the size at which a shard's WAL moves on to a new
+	// segment. Segments are deleted once their writes are in SSTables.
+	WALSegmentSize int64
+	// WALRetention keeps segments for this long after their writes reach
+	// SSTables, so that subscribers can replay them. Zero deletes them
+	// right away.
+	WALRetention time.Duration
+	// WALArchiveDir, if set, is where a copy of each WAL segment is kept
+	// once the shard has moved on to the next, for Restore. Archived
+	// segments are never deleted by the DB.
+	WALArchiveDir string
+	// ReadUncommitted makes writes visible to readers as soon as they are
+	// queued for the WAL instead of once they are logged. Reads may then
+	// see writes that a crash or a failed sync loses.
+	ReadUncommitted bool
+}
+
+// Durability decides when the WAL is synced.
+type Durability = keystore.Durability
+
+const (
+	// SyncEveryBatch syncs the WAL before acknowledging any write. It is
+	// the default.
+	SyncEveryBatch = keystore.SyncEveryBatch
+	// SyncInterval syncs at most once per Options.SyncInterval; a crash
+	// can lose up to one interval of acknowledged writes.
+	SyncInterval = keystore.SyncInterval
+	// NoSync never syncs and relies on the operating system to write the
+	// WAL back. Writes survive a process crash but not a machine crash.
+	NoSync = keystore.NoSync
+)
+
+// WriteOptions overrides the DB's durability for one write. Set Sync for
+// writes that must be on stable storage when acknowledged and NoSync for
+// writes that may be lost in a machine crash.
+type WriteOptions = keystore.WriteOptions
+
+// WriteFuture is a write returned by SetAsync or DeleteAsync. Done is
+// closed once it has reached the WAL, with the durability the DB is
+// configured for, and is visible to readers. Wait returns its error.
+type WriteFuture = keystore.WriteFuture
+
+// Event is one committed Set or Delete as seen by a subscriber. Seq orders
+// events across all shards; the writes of one batch on one shard share it.
+type Event = keystore.Event
+
+type EventType = keystore.EventType
+
+const (
+	EventSet    = keystore.EventSet
+	EventDelete = keystore.EventDelete
+)
+
+// Subscription is a stream of events returned by DB.Subscribe.
+type Subscription = keystore.Subscription
+
+// Batch collects Puts, Deletes and DeleteRanges to apply together with
+// DB.Write.
+type Batch = keystore.Batch
+
+// WALRecoveryMode decides how damaged WAL records are handled on open.
+type WALRecoveryMode = keystore.WALRecoveryMode
+
+const (
+	// WALTolerateTail drops a record torn by a crash at the end of a WAL
+	// and fails on damage anywhere else. It is the default.
+	WALTolerateTail = keystore.WALTolerateTail
+	// WALStrict fails on any damaged record, including a torn tail.
+	WALStrict = keystore.WALStrict
+	// WALSkipCorrupted drops every damaged record and keeps the rest,
+	// losing the writes they held.
+	WALSkipCorrupted = keystore.WALSkipCorrupted
+)
+
+// Compression names a block compression codec.
+type Compression int
+
+const (
+	NoCompression Compression = iota
+	FlateCompression
+)
+
+func (c Compression) codec() SSTables.Codec {
+	switch c {
+	case FlateCompression:
+		return SSTables.FlateCompression
+	default:
+		return SSTables.NoCompression
+	}
+}
+
+// DefaultOptions returns the options used by Open.
+func DefaultOptions() Options {
+	return Options{
+		BloomFalsePositiveRate: keystore.DefaultOptions().Table.BloomFalsePositiveRate,
+		Compression:            NoCompression,
+		MaxOpenFiles:           keystore.DefaultOptions().MaxOpenFiles,
+		BlockCacheSize:         keystore.DefaultOptions().BlockCacheSize,
+		Durability:             SyncEveryBatch,
+		SyncInterval:           keystore.DefaultOptions().SyncInterval,
+		WALBatchSize:           keystore.DefaultOptions().WALBatchSize,
+		WALBatchInterval:       keystore.DefaultOptions().WALBatchInterval,
+		WALSegmentSize:         keystore.DefaultOptions().WALSegmentSize,
+	}
+}
+
+func (o Options) keystoreOptions() keystore.Options {
+	kopts := keystore.DefaultOptions()
+	kopts.Table.BloomFalsePositiveRate = o.BloomFalsePositiveRate
+	kopts.Table.Codec = o.Compression.codec()
+	kopts.MaxOpenFiles = o.MaxOpenFiles
+	kopts.Mmap = o.Mmap
+	kopts.BlockCacheSize = o.BlockCacheSize
+	kopts.WALRecovery = o.WALRecovery
+	kopts.Durability = o.Durability
+	kopts.SyncInterval = o.SyncInterval
+	kopts.WALBatchSize = o.WALBatchSize
+	kopts.WALBatchInterval = o.WALBatchInterval
+	kopts.WALSegmentSize = o.WALSegmentSize
+	kopts.WALRetention = o.WALRetention
+	kopts.WALArchiveDir = o.WALArchiveDir
+	kopts.ReadUncommitted = o.ReadUncommitted
+	return kopts
+}
+
 // Open creates or opens a MinionDB instance at the given path.
 // `shards` controls the number of shard partitions (parallelism).
 func Open(path string, shards int) (*DB, error) {
+	return OpenWithOptions(path, shards, DefaultOptions())
+}
+
+// OpenWithOptions is like Open but lets the caller tune the engine.
+func OpenWithOptions(path string, shards int, opts Options) (*DB, error) {
 	logger.InitLogger(slog.LevelInfo)
-	skv, err := keystore.NewShardedKV(path, shards)
+	skv, err := keystore.NewShardedKV(path, shards, opts.keystoreOptions())
 	if err != nil {
 		return nil, err
 	}
@@ -26,6 +234,27 @@ func Open(path string, shards int) (*DB, error) {
 	return &DB{skv: skv}, nil
 }
 
+// Upgrade converts a data directory written before format versioning to the
+// current format in place and returns the files it rewrote. The directory
+// must not be open.
+func Upgrade(path string) ([]string, error) {
+	return keystore.Upgrade(path)
+}
+
+// RestorePoint is where Restore stops: after the write numbered Seq, as in
+// Event.Seq, or, if Seq is zero, after the last write made at or before
+// Time.
+type RestorePoint = keystore.RestorePoint
+
+// Restore creates a DB at target, which must not exist, as it stood at the
+// given point: the checkpoint written by DB.Checkpoint with the WAL segments
+// archived to archive since then replayed on top. The restored DB should be
+// given a new WALArchiveDir.
+func Restore(checkpoint, archive, target string, to RestorePoint) error {
+	logger.InitLogger(slog.LevelInfo)
+	return keystore.Restore(checkpoint, archive, target, to, DefaultOptions().keystoreOptions())
+}
+
 // Set stores a value for the given key.
 func (db *DB) Set(key string, value []byte) error {
 	if db.skv == nil {
@@ -34,14 +263,80 @@ func (db *DB) Set(key string, value []byte) error {
 	return db.skv.Set(key, value)
 }
 
-// Get retrieves the value for a given key.
-func (db *DB) Get(key string) ([]byte, bool) {
+// SetWithOptions is Set with per-write durability.
+func (db *DB) SetWithOptions(key string, value []byte, wo WriteOptions) error {
 	if db.skv == nil {
-		return nil, false
+		return errors.New("miniondb: db is closed")
+	}
+	return db.skv.SetWithOptions(key, value, wo)
+}
+
+// SetCtx is Set for callers that cannot wait indefinitely. It fails with
+// ErrBusy rather than wait for a full WAL queue, leaves flushing a full
+// memtable to the background, and fails with ctx's error if ctx is done
+// before the write is logged; the write may then still be applied.
+func (db *DB) SetCtx(ctx context.Context, key string, value []byte) error {
+	if db.skv == nil {
+		return errors.New("miniondb: db is closed")
+	}
+	return db.skv.SetCtx(ctx, key, value)
+}
+
+// SetAsync stores a value for the key without waiting for the WAL. The
+// write becomes visible to readers once it is logged, when the returned
+// future is done, or under ReadUncommitted as soon as it is queued; Wait
+// says whether it was logged. SetAsync blocks only while the WAL queue is
+// full.
+func (db *DB) SetAsync(key string, value []byte) *WriteFuture {
+	if db.skv == nil {
+		return keystore.FailedWrite(errors.New("miniondb: db is closed"))
+	}
+	return db.skv.SetAsync(key, value)
+}
+
+// Get retrieves the value for a given key. A damaged SSTable is reported
+// as an error matching ErrCorruption rather than as a missing key.
+func (db *DB) Get(key string) ([]byte, bool, error) {
+	if db.skv == nil {
+		return nil, false, errors.New("miniondb: db is closed")
 	}
 	return db.skv.Get(key)
 }
 
+// GetWithOptions is Get with per-read options. Clear FillCache for reads
+// that should not displace hot blocks from the cache.
+func (db *DB) GetWithOptions(key string, ro ReadOptions) ([]byte, bool, error) {
+	if db.skv == nil {
+		return nil, false, errors.New("miniondb: db is closed")
+	}
+	return db.skv.GetWithOptions(key, ro)
+}
+
+// GetCtx is Get that returns ctx's error once ctx is done.
+func (db *DB) GetCtx(ctx context.Context, key string) ([]byte, bool, error) {
+	if db.skv == nil {
+		return nil, false, errors.New("miniondb: db is closed")
+	}
+	return db.skv.GetCtx(ctx, key)
+}
+
+// Err returns the DegradedError that made the DB read-only, or nil while it
+// accepts writes.
+func (db *DB) Err() error {
+	if db.skv == nil {
+		return errors.New("miniondb: db is closed")
+	}
+	return db.skv.Err()
+}
+
+// CacheStats returns the block cache's counters.
+func (db *DB) CacheStats() CacheStats {
+	if db.skv == nil {
+		return CacheStats{}
+	}
+	return db.skv.CacheStats()
+}
+
 // Delete removes a key from the database.
 func (db *DB) Delete(key string) error {
 	if db.skv == nil {
@@ -50,6 +345,66 @@ func (db *DB) Delete(key string) error {
 	return db.skv.Delete(key)
 }
 
+// DeleteWithOptions is Delete with per-write durability.
+func (db *DB) DeleteWithOptions(key string, wo WriteOptions) error {
+	if db.skv == nil {
+		return errors.New("miniondb: db is closed")
+	}
+	return db.skv.DeleteWithOptions(key, wo)
+}
+
+// DeleteCtx is Delete with the queueing and cancellation of SetCtx.
+func (db *DB) DeleteCtx(ctx context.Context, key string) error {
+	if db.skv == nil {
+		return errors.New("miniondb: db is closed")
+	}
+	return db.skv.DeleteCtx(ctx, key)
+}
+
+// DeleteAsync is Delete that does not wait for the WAL, like SetAsync.
+func (db *DB) DeleteAsync(key string) *WriteFuture {
+	if db.skv == nil {
+		return keystore.FailedWrite(errors.New("miniondb: db is closed"))
+	}
+	return db.skv.DeleteAsync(key)
+}
+
+// Write applies every write in b atomically: they become visible to readers
+// together, and a crash never leaves part of them applied. A batch whose
+// keys land on more than one shard is committed in two phases and always
+// synced, whatever the durability.
+func (db *DB) Write(b *Batch, wo WriteOptions) error {
+	if db.skv == nil {
+		return errors.New("miniondb: db is closed")
+	}
+	return db.skv.Write(b, wo)
+}
+
+// Subscribe returns a stream of the events numbered fromSeq or later, in
+// order. Events already written are replayed from the retained WAL
+// segments, so a reader that persists the Seq of the last event it handled
+// can resume from the next one after a restart. A fromSeq of zero starts
+// with the next write.
+func (db *DB) Subscribe(fromSeq uint64) (*Subscription, error) {
+	if db.skv == nil {
+		return nil, errors.New("miniondb: db is closed")
+	}
+	return db.skv.Subscribe(fromSeq)
+}
+
+// Checkpoint writes a copy of the DB to dir, which must not exist. The copy
+// can be opened as a DB or restored from with Restore. Shards are copied one
+// after another while other writes carry on, so the copy holds every
+// cross-shard batch whole but may hold a single-shard write made after one
+// on another shard that it lacks. Restore to a point to get the DB as it
+// stood at one moment.
+func (db *DB) Checkpoint(dir string) error {
+	if db.skv == nil {
+		return errors.New("miniondb: db is closed")
+	}
+	return db.skv.Checkpoint(dir)
+}
+
 // Close flushes all WALs, stops background tasks, and closes the DB.
 func (db *DB) Close() error {
 	if db.skv == nil {
@@ -0,0 +1,55 @@
+package miniondb
+
+import (
+	"errors"
+
+	"github.com/Aswin-Sk/MinionDB/internal/SSTables"
+)
+
+// SSTWriter builds an SSTable offline for IngestExternalFiles. Keys must be
+// added in strictly ascending order.
+type SSTWriter struct {
+	w *SSTables.Writer
+}
+
+// NewSSTWriter creates an SSTable at path, written with the table settings
+// in opts.
+func NewSSTWriter(path string, opts Options) (*SSTWriter, error) {
+	w, err := SSTables.NewWriter(path, opts.keystoreOptions().Table)
+	if err != nil {
+		return nil, err
+	}
+	return &SSTWriter{w: w}, nil
+}
+
+// Put adds a key with its value.
+func (sw *SSTWriter) Put(key string, value []byte) error {
+	return sw.w.Add(key, value, SSTables.KindPut)
+}
+
+// Delete adds a tombstone that removes key from the DB on ingestion.
+func (sw *SSTWriter) Delete(key string) error {
+	return sw.w.Add(key, nil, SSTables.KindDelete)
+}
+
+// Finish completes and syncs the file. If it fails the file is removed.
+func (sw *SSTWriter) Finish() error {
+	return sw.w.Finish()
+}
+
+// Abort discards the file.
+func (sw *SSTWriter) Abort() error {
+	return sw.w.Abort()
+}
+
+// IngestExternalFiles adds SSTables built with SSTWriter to the DB. Their
+// keys are routed to shards the same way Set routes them, splitting the
+// files as needed. Ingested data is newer than every write that completed
+// before the call; among the files, a later path wins over an earlier one
+// for the same key. The source files are not modified.
+func (db *DB) IngestExternalFiles(paths []string) error {
+	if db.skv == nil {
+		return errors.New("miniondb: db is closed")
+	}
+	return db.skv.IngestExternalFiles(paths)
+}
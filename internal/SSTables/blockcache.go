@@ -0,0 +1,136 @@
+package SSTables
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+)
+
+const blockCacheShards = 16
+
+// ReadOptions controls a single read.
+type ReadOptions struct {
+	// FillCache adds the blocks the read loads from disk to the block
+	// cache. Large scans should clear it so they do not push out hot
+	// blocks.
+	FillCache bool
+}
+
+func DefaultReadOptions() ReadOptions {
+	return ReadOptions{FillCache: true}
+}
+
+// CacheStats is a snapshot of a BlockCache's counters.
+type CacheStats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	// Size and Capacity are in bytes.
+	Size     int64
+	Capacity int64
+}
+
+// BlockCache holds decompressed data blocks in memory under a single byte
+// budget. It is split into independently locked shards, each evicting its
+// least recently used blocks once it is over its share of the budget.
+// Blocks are never modified once cached, so readers may keep using a block
+// after it has been evicted.
+type BlockCache struct {
+	shards    [blockCacheShards]blockCacheShard
+	capacity  int64
+	hits      atomic.Uint64
+	misses    atomic.Uint64
+	evictions atomic.Uint64
+}
+
+type blockKey struct {
+	table  uint64
+	offset uint64
+}
+
+type cachedBlock struct {
+	key  blockKey
+	data []byte
+}
+
+type blockCacheShard struct {
+	mu       sync.Mutex
+	capacity int64
+	size     int64
+	lru      list.List // of *cachedBlock, most recently used first
+	blocks   map[blockKey]*list.Element
+}
+
+// NewBlockCache returns a cache holding up to capacity bytes of blocks.
+func NewBlockCache(capacity int64) *BlockCache {
+	c := &BlockCache{capacity: capacity}
+	for i := range c.shards {
+		c.shards[i].capacity = capacity / blockCacheShards
+		c.shards[i].blocks = make(map[blockKey]*list.Element)
+	}
+	return c
+}
+
+func (c *BlockCache) shard(k blockKey) *blockCacheShard {
+	h := k.table*0x9e3779b97f4a7c15 ^ k.offset
+	h ^= h >> 31
+	return &c.shards[h%blockCacheShards]
+}
+
+func (c *BlockCache) get(k blockKey) ([]byte, bool) {
+	s := c.shard(k)
+	s.mu.Lock()
+	e, ok := s.blocks[k]
+	if ok {
+		s.lru.MoveToFront(e)
+	}
+	s.mu.Unlock()
+	if !ok {
+		c.misses.Add(1)
+		return nil, false
+	}
+	c.hits.Add(1)
+	return e.Value.(*cachedBlock).data, true
+}
+
+// insert caches data, which the cache takes ownership of. Blocks larger
+// than a shard's share of the budget are not cached.
+func (c *BlockCache) insert(k blockKey, data []byte) {
+	s := c.shard(k)
+	n := int64(len(data))
+	if n > s.capacity {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.blocks[k]; ok {
+		return
+	}
+	s.blocks[k] = s.lru.PushFront(&cachedBlock{key: k, data: data})
+	s.size += n
+	for s.size > s.capacity {
+		e := s.lru.Back()
+		b := e.Value.(*cachedBlock)
+		s.lru.Remove(e)
+		delete(s.blocks, b.key)
+		s.size -= int64(len(b.data))
+		c.evictions.Add(1)
+	}
+}
+
+// Stats returns the cache's counters.
+func (c *BlockCache) Stats() CacheStats {
+	st := CacheStats{
+		Hits:      c.hits.Load(),
+		Misses:    c.misses.Load(),
+		Evictions: c.evictions.Load(),
+		Capacity:  c.capacity,
+	}
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.mu.Lock()
+		st.Size += s.size
+		s.mu.Unlock()
+	}
+	return st
+}
@@ -0,0 +1,72 @@
+package SSTables
+
+import "testing"
+
+func TestBlockCacheReads(t *testing.T) {
+	blocks := NewBlockCache(1 << 20)
+	cache := NewTableCache(4, false, blocks)
+	defer cache.Close()
+	recs := puts(500)
+	tbl, err := cache.Open(writeTestTable(t, DefaultOptions(), recs))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	noFill := ReadOptions{FillCache: false}
+	for range 2 {
+		if _, _, _, err := tbl.GetWithOptions(recs[0].key, noFill); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if st := blocks.Stats(); st.Misses != 2 || st.Hits != 0 || st.Size != 0 {
+		t.Fatalf("after reads that skip the cache: %+v, want 2 misses and nothing cached", st)
+	}
+	it, err := tbl.NewIteratorWithOptions(noFill)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for it.Next() {
+	}
+	it.Close()
+	if st := blocks.Stats(); st.Size != 0 {
+		t.Fatalf("scan that skips the cache filled it: %+v", st)
+	}
+
+	for range 2 {
+		if _, _, _, err := tbl.Get(recs[0].key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	st := blocks.Stats()
+	if st.Hits != 1 || st.Size == 0 {
+		t.Fatalf("after filling reads: %+v, want 1 hit and a cached block", st)
+	}
+	// The cached block serves every key in it.
+	if val, _, ok, err := tbl.Get(recs[1].key); err != nil || !ok || string(val) != recs[1].val {
+		t.Fatalf("Get(%s) = %q, %v, %v", recs[1].key, val, ok, err)
+	}
+	if got := blocks.Stats().Hits; got != st.Hits+1 {
+		t.Fatalf("hits %d, want %d", got, st.Hits+1)
+	}
+}
+
+func TestBlockCacheEviction(t *testing.T) {
+	const capacity = blockCacheShards * 100
+	c := NewBlockCache(capacity)
+	for i := range 1000 {
+		c.insert(blockKey{table: 1, offset: uint64(i)}, make([]byte, 60))
+	}
+	st := c.Stats()
+	if st.Size > capacity || st.Evictions == 0 {
+		t.Fatalf("stats %+v, want evictions and at most %d bytes", st, capacity)
+	}
+	// The most recent insert is cached.
+	if _, ok := c.get(blockKey{table: 1, offset: 999}); !ok {
+		t.Fatal("newest block evicted")
+	}
+	// A block over a shard's share is never cached.
+	c.insert(blockKey{table: 2}, make([]byte, 101))
+	if _, ok := c.get(blockKey{table: 2}); ok {
+		t.Fatal("cached a block larger than a shard's budget")
+	}
+}
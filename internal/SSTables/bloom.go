@@ -0,0 +1,74 @@
+package SSTables
+
+import (
+	"hash/fnv"
+	"math"
+)
+
+// bloomFilter is a standard Bloom filter using double hashing over a single
+// 64-bit FNV-1a hash. Its encoded form is the bit array followed by one byte
+// holding the number of probes.
+type bloomFilter struct {
+	bits []byte
+	k    uint8
+}
+
+func newBloomFilter(n int, fpRate float64) *bloomFilter {
+	if n < 1 {
+		n = 1
+	}
+	m := int(math.Ceil(-float64(n) * math.Log(fpRate) / (math.Ln2 * math.Ln2)))
+	if m < 64 {
+		m = 64
+	}
+	k := int(math.Round(float64(m) / float64(n) * math.Ln2))
+	k = max(1, min(k, 30))
+	return &bloomFilter{
+		bits: make([]byte, (m+7)/8),
+		k:    uint8(k),
+	}
+}
+
+// decodeBloomFilter copies the bits out of b, which may be a mapped file
+// that does not outlive the read.
+func decodeBloomFilter(b []byte) (*bloomFilter, error) {
+	if len(b) < 2 {
+		return nil, errBadBlock
+	}
+	return &bloomFilter{bits: append([]byte(nil), b[:len(b)-1]...), k: b[len(b)-1]}, nil
+}
+
+func (bf *bloomFilter) encode() []byte {
+	return append(append([]byte(nil), bf.bits...), bf.k)
+}
+
+func (bf *bloomFilter) add(h uint64) {
+	h1, h2 := splitHash(h)
+	m := uint32(len(bf.bits) * 8)
+	for i := uint32(0); i < uint32(bf.k); i++ {
+		bit := (h1 + i*h2) % m
+		bf.bits[bit/8] |= 1 << (bit % 8)
+	}
+}
+
+func (bf *bloomFilter) mayContain(key string) bool {
+	h1, h2 := splitHash(bloomHash(key))
+	m := uint32(len(bf.bits) * 8)
+	for i := uint32(0); i < uint32(bf.k); i++ {
+		bit := (h1 + i*h2) % m
+		if bf.bits[bit/8]&(1<<(bit%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func bloomHash(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return h.Sum64()
+}
+
+func splitHash(h uint64) (uint32, uint32) {
+	return uint32(h), uint32(h>>32) | 1
+}
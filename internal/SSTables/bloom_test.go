@@ -0,0 +1,52 @@
+package SSTables
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestBloomFilter(t *testing.T) {
+	const n, rate = 10000, 0.01
+	bf := newBloomFilter(n, rate)
+	for i := range n {
+		bf.add(bloomHash(fmt.Sprintf("key-%d", i)))
+	}
+	bf, err := decodeBloomFilter(bf.encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range n {
+		if key := fmt.Sprintf("key-%d", i); !bf.mayContain(key) {
+			t.Fatalf("false negative for %s", key)
+		}
+	}
+	fp := 0
+	for i := range n {
+		if bf.mayContain(fmt.Sprintf("absent-%d", i)) {
+			fp++
+		}
+	}
+	if got := float64(fp) / n; got > 2*rate {
+		t.Fatalf("false-positive rate %.4f, want about %.2f", got, rate)
+	}
+}
+
+func TestTableFilter(t *testing.T) {
+	recs := puts(500)
+	tbl := openTestTable(t, writeTestTable(t, DefaultOptions(), recs))
+	for _, r := range recs {
+		if !tbl.MayContain(r.key) {
+			t.Fatalf("false negative for %s", r.key)
+		}
+	}
+	if tbl.MayContain("absent") && tbl.MayContain("missing") && tbl.MayContain("gone") {
+		t.Fatal("filter passes every absent key")
+	}
+
+	opts := DefaultOptions()
+	opts.BloomFalsePositiveRate = 0
+	tbl = openTestTable(t, writeTestTable(t, opts, recs))
+	if tbl.filter != nil || !tbl.MayContain("absent") {
+		t.Fatal("table written without a filter rules keys out")
+	}
+}
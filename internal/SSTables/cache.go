@@ -0,0 +1,129 @@
+package SSTables
+
+import (
+	"container/list"
+	"errors"
+	"sync"
+)
+
+// TableCache bounds the number of table files held open across every table
+// opened through it. Files are opened on first read and closed in
+// least-recently-used order once more than capacity are cached. A file that
+// is evicted while a read is using it stays open until that read is done.
+type TableCache struct {
+	mu       sync.Mutex
+	capacity int
+	mmap     bool
+	blocks   *BlockCache
+	lru      *list.List // of *cachedFile, most recently used first
+	files    map[string]*cachedFile
+}
+
+// cachedFile counts one reference for each read in progress plus one while
+// it is in the cache. The file is closed when the count reaches zero.
+type cachedFile struct {
+	path string
+	f    readFile
+	refs int
+	elem *list.Element
+}
+
+// NewTableCache returns a cache that keeps up to capacity files open,
+// memory-mapping them when useMmap is set. Tables opened through it cache
+// their data blocks in blocks, unless it is nil.
+func NewTableCache(capacity int, useMmap bool, blocks *BlockCache) *TableCache {
+	return &TableCache{
+		capacity: max(capacity, 1),
+		mmap:     useMmap,
+		blocks:   blocks,
+		lru:      list.New(),
+		files:    make(map[string]*cachedFile),
+	}
+}
+
+// Open loads the table at path and serves its reads through the cache.
+func (c *TableCache) Open(path string) (*SSTable, error) {
+	return openSSTable(path, c)
+}
+
+func (c *TableCache) acquire(path string) (*cachedFile, error) {
+	c.mu.Lock()
+	if cf, ok := c.files[path]; ok {
+		cf.refs++
+		c.lru.MoveToFront(cf.elem)
+		c.mu.Unlock()
+		return cf, nil
+	}
+	c.mu.Unlock()
+
+	f, err := openFile(path, c.mmap)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cf, ok := c.files[path]; ok {
+		// Another reader opened it first.
+		f.Close()
+		cf.refs++
+		c.lru.MoveToFront(cf.elem)
+		return cf, nil
+	}
+	cf := &cachedFile{path: path, f: f, refs: 2}
+	cf.elem = c.lru.PushFront(cf)
+	c.files[path] = cf
+	for c.lru.Len() > c.capacity {
+		c.removeLocked(c.lru.Back().Value.(*cachedFile))
+	}
+	return cf, nil
+}
+
+func (c *TableCache) release(cf *cachedFile) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.unrefLocked(cf)
+}
+
+func (c *TableCache) unrefLocked(cf *cachedFile) error {
+	cf.refs--
+	if cf.refs == 0 {
+		return cf.f.Close()
+	}
+	return nil
+}
+
+func (c *TableCache) removeLocked(cf *cachedFile) error {
+	c.lru.Remove(cf.elem)
+	delete(c.files, cf.path)
+	return c.unrefLocked(cf)
+}
+
+// Evict drops the file at path from the cache. It is closed once no read is
+// using it.
+func (c *TableCache) Evict(path string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cf, ok := c.files[path]; ok {
+		return c.removeLocked(cf)
+	}
+	return nil
+}
+
+// Len returns the number of files in the cache.
+func (c *TableCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+// Close evicts every file.
+func (c *TableCache) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var errs []error
+	for c.lru.Len() > 0 {
+		errs = append(errs, c.removeLocked(c.lru.Front().Value.(*cachedFile)))
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,89 @@
+package SSTables
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestTableCacheCapacity(t *testing.T) {
+	for _, mmap := range []bool{false, true} {
+		t.Run(fmt.Sprintf("mmap=%v", mmap), func(t *testing.T) {
+			cache := NewTableCache(2, mmap, nil)
+			defer cache.Close()
+			recs := puts(500)
+			var tables []*SSTable
+			for range 5 {
+				tbl, err := cache.Open(writeTestTable(t, DefaultOptions(), recs))
+				if err != nil {
+					t.Fatal(err)
+				}
+				tables = append(tables, tbl)
+			}
+
+			// An iterator keeps reading its file while the others push it
+			// out of the cache.
+			it, err := tables[0].NewIterator()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer it.Close()
+			i := 0
+			for ; it.Next(); i++ {
+				if it.Key() != recs[i].key || string(it.Value()) != recs[i].val {
+					t.Fatalf("record %d = %s=%q, want %s=%q", i, it.Key(), it.Value(), recs[i].key, recs[i].val)
+				}
+				if i == 0 {
+					for _, tbl := range tables[1:] {
+						if _, _, ok, err := tbl.Get(recs[i].key); err != nil || !ok {
+							t.Fatalf("Get(%s) = %v, %v", recs[i].key, ok, err)
+						}
+					}
+				}
+			}
+			if err := it.Err(); err != nil || i != len(recs) {
+				t.Fatalf("iterated %d records, %v; want %d", i, err, len(recs))
+			}
+			if n := cache.Len(); n > 2 {
+				t.Fatalf("cache holds %d files, want at most 2", n)
+			}
+			for _, tbl := range tables {
+				if val, _, ok, err := tbl.Get(recs[250].key); err != nil || !ok || string(val) != recs[250].val {
+					t.Fatalf("Get(%s) = %q, %v, %v", recs[250].key, val, ok, err)
+				}
+			}
+		})
+	}
+}
+
+func TestObsoleteTableRemovedOnLastUnref(t *testing.T) {
+	cache := NewTableCache(4, false, nil)
+	defer cache.Close()
+	path := writeTestTable(t, DefaultOptions(), puts(10))
+	tbl, err := cache.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := tbl.Get("key-00001"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A lookup still holds the table when compaction retires it.
+	tbl.Ref()
+	tbl.MarkObsolete()
+	if err := tbl.Unref(); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, ok, err := tbl.Get("key-00001"); err != nil || !ok {
+		t.Fatalf("Get from a referenced obsolete table: %v, %v", ok, err)
+	}
+	if err := tbl.Unref(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("obsolete table kept after its last reference: %v", err)
+	}
+	if n := cache.Len(); n != 0 {
+		t.Fatalf("cache holds %d files after the table went, want 0", n)
+	}
+}
@@ -0,0 +1,90 @@
+package SSTables
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Codec compresses data blocks. The codec a table was written with is
+// recorded in its footer by ID, so the ID of a registered codec must never
+// change once tables using it exist on disk.
+type Codec interface {
+	ID() byte
+	Name() string
+	Encode(src []byte) ([]byte, error)
+	Decode(src []byte) ([]byte, error)
+}
+
+const (
+	NoCompressionID    byte = 0
+	FlateCompressionID byte = 1
+)
+
+var (
+	NoCompression    Codec = noCodec{}
+	FlateCompression Codec = flateCodec{level: flate.BestSpeed}
+)
+
+var (
+	codecsMu sync.RWMutex
+	codecs   = map[byte]Codec{
+		NoCompressionID:    NoCompression,
+		FlateCompressionID: FlateCompression,
+	}
+)
+
+// RegisterCodec makes c available for reading tables that were written
+// with it. Registering a second codec under an existing ID panics.
+func RegisterCodec(c Codec) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	if _, dup := codecs[c.ID()]; dup {
+		panic(fmt.Sprintf("sstable: codec id %d registered twice", c.ID()))
+	}
+	codecs[c.ID()] = c
+}
+
+func codecByID(id byte) (Codec, bool) {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	c, ok := codecs[id]
+	return c, ok
+}
+
+type noCodec struct{}
+
+func (noCodec) ID() byte                          { return NoCompressionID }
+func (noCodec) Name() string                      { return "none" }
+func (noCodec) Encode(src []byte) ([]byte, error) { return src, nil }
+func (noCodec) Decode(src []byte) ([]byte, error) { return src, nil }
+
+type flateCodec struct {
+	level int
+}
+
+func (flateCodec) ID() byte     { return FlateCompressionID }
+func (flateCodec) Name() string { return "flate" }
+
+func (c flateCodec) Encode(src []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, c.level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (flateCodec) Decode(src []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(src))
+	defer r.Close()
+	return io.ReadAll(r)
+}
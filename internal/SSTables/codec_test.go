@@ -0,0 +1,81 @@
+package SSTables
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+// xorCodec is a toy codec; only the one with id 200 is registered.
+type xorCodec struct{ id byte }
+
+func (c xorCodec) ID() byte                        { return c.id }
+func (xorCodec) Name() string                      { return "xor" }
+func (xorCodec) Encode(src []byte) ([]byte, error) { return xor(src), nil }
+func (xorCodec) Decode(src []byte) ([]byte, error) { return xor(src), nil }
+
+func init() {
+	RegisterCodec(xorCodec{id: 200})
+}
+
+func xor(src []byte) []byte {
+	dst := make([]byte, len(src))
+	for i, b := range src {
+		dst[i] = b ^ 0x5a
+	}
+	return dst
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	custom := xorCodec{id: 200}
+	recs := puts(500)
+	for _, codec := range []Codec{NoCompression, FlateCompression, custom} {
+		t.Run(codec.Name(), func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.Codec = codec
+			tbl := openTestTable(t, writeTestTable(t, opts, recs))
+			if tbl.codec.ID() != codec.ID() {
+				t.Fatalf("table opened with codec %d, want %d", tbl.codec.ID(), codec.ID())
+			}
+			for _, r := range recs {
+				if val, _, ok, err := tbl.Get(r.key); err != nil || !ok || string(val) != r.val {
+					t.Fatalf("Get(%s) = %q, %v, %v; want %q", r.key, val, ok, err, r.val)
+				}
+			}
+		})
+	}
+}
+
+func TestFlateCompresses(t *testing.T) {
+	recs := puts(500)
+	size := func(codec Codec) int64 {
+		opts := DefaultOptions()
+		opts.Codec = codec
+		fi, err := os.Stat(writeTestTable(t, opts, recs))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fi.Size()
+	}
+	if raw, flate := size(NoCompression), size(FlateCompression); flate >= raw {
+		t.Fatalf("flate table is %d bytes, raw is %d", flate, raw)
+	}
+}
+
+func TestUnknownCodec(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Codec = xorCodec{id: 201}
+	path := writeTestTable(t, opts, puts(10))
+	if _, err := OpenSSTable(path); err == nil || !strings.Contains(err.Error(), "unknown codec id 201") {
+		t.Fatalf("OpenSSTable with an unregistered codec: %v", err)
+	}
+}
+
+func TestRegisterCodecTwicePanics(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("registering a taken codec id did not panic")
+		}
+	}()
+	RegisterCodec(xorCodec{id: FlateCompressionID})
+}
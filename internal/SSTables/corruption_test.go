@@ -0,0 +1,89 @@
+package SSTables
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/Aswin-Sk/MinionDB/internal/fileformat"
+)
+
+// flipByte inverts the byte at off in the file at path.
+func flipByte(t *testing.T, path string, off int64) {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b[off] ^= 0xff
+	if err := os.WriteFile(path, b, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDataBlockChecksumMismatch(t *testing.T) {
+	recs := puts(500)
+	path := writeTestTable(t, DefaultOptions(), recs)
+	tbl := openTestTable(t, path)
+	h := tbl.index[1].handle
+	flipByte(t, path, int64(h.offset)+10)
+
+	_, _, _, err := tbl.Get(tbl.index[1].firstKey)
+	var ce *CorruptionError
+	if !errors.As(err, &ce) || ce.Offset != int64(h.offset) {
+		t.Fatalf("Get from a damaged block: got %v, want corruption at %d", err, h.offset)
+	}
+	// Other blocks still read.
+	if _, _, ok, err := tbl.Get(recs[0].key); err != nil || !ok {
+		t.Fatalf("Get from an intact block: %v, %v", ok, err)
+	}
+
+	it, err := tbl.NewIterator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer it.Close()
+	for it.Next() {
+	}
+	if !errors.Is(it.Err(), ErrCorruption) {
+		t.Fatalf("iterating over a damaged block: got %v, want ErrCorruption", it.Err())
+	}
+}
+
+func TestOpenChecksumMismatch(t *testing.T) {
+	tests := []struct {
+		name string
+		off  func(size int64) int64
+	}{
+		{"footer", func(size int64) int64 {
+			return size - fileformat.StampSize - footerSize + 2
+		}},
+		{"index", func(size int64) int64 {
+			// The index block sits just before the footer.
+			return size - fileformat.StampSize - footerSize - blockTrailerSize - 1
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeTestTable(t, DefaultOptions(), puts(100))
+			fi, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			flipByte(t, path, tt.off(fi.Size()))
+			if _, err := OpenSSTable(path); !errors.Is(err, ErrCorruption) {
+				t.Fatalf("OpenSSTable: got %v, want ErrCorruption", err)
+			}
+		})
+	}
+}
+
+func TestOpenTruncatedTable(t *testing.T) {
+	path := writeTestTable(t, DefaultOptions(), puts(100))
+	if err := os.Truncate(path, footerSize-1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenSSTable(path); err == nil {
+		t.Fatal("opened a truncated table")
+	}
+}
@@ -0,0 +1,29 @@
+package SSTables
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrCorruption matches every CorruptionError via errors.Is.
+var ErrCorruption = errors.New("corruption")
+
+// CorruptionError reports a table, or a WAL, whose on-disk bytes failed a
+// checksum or could not be decoded.
+type CorruptionError struct {
+	Path   string
+	Offset int64
+	Reason string
+}
+
+func (e *CorruptionError) Error() string {
+	return fmt.Sprintf("corruption in %s at offset %d: %s", e.Path, e.Offset, e.Reason)
+}
+
+func (e *CorruptionError) Is(target error) bool {
+	return target == ErrCorruption
+}
+
+func corruption(path string, offset int64, reason string) error {
+	return &CorruptionError{Path: path, Offset: offset, Reason: reason}
+}
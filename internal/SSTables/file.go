@@ -0,0 +1,74 @@
+package SSTables
+
+import (
+	"io"
+	"os"
+)
+
+// readFile is the read side of a table file, backed either by an open
+// *os.File or by a read-only memory mapping of the whole file.
+type readFile interface {
+	io.ReaderAt
+	Name() string
+	Size() int64
+	Close() error
+}
+
+type osFile struct {
+	*os.File
+	size int64
+}
+
+func (f *osFile) Size() int64 { return f.size }
+
+// mmapFile serves reads straight from a mapping of the file. Slices handed
+// out by bytes are only valid until Close.
+type mmapFile struct {
+	name string
+	data []byte
+}
+
+func (m *mmapFile) Name() string { return m.name }
+func (m *mmapFile) Size() int64  { return int64(len(m.data)) }
+func (m *mmapFile) Close() error { return munmap(m.data) }
+
+func (m *mmapFile) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 || off >= int64(len(m.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, m.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// bytes returns the n bytes at off without copying them.
+func (m *mmapFile) bytes(off, n int64) ([]byte, bool) {
+	if off < 0 || n < 0 || off+n > int64(len(m.data)) {
+		return nil, false
+	}
+	return m.data[off : off+n : off+n], true
+}
+
+// openFile opens the table file at path, mapping it into memory when
+// useMmap is set and the platform supports it. Empty files and failed
+// mappings fall back to plain reads.
+func openFile(path string, useMmap bool) (readFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if useMmap && st.Size() > 0 {
+		if data, err := mmap(f, st.Size()); err == nil {
+			f.Close()
+			return &mmapFile{name: path, data: data}, nil
+		}
+	}
+	return &osFile{File: f, size: st.Size()}, nil
+}
@@ -0,0 +1,257 @@
+package SSTables
+
+import (
+	"container/heap"
+	"errors"
+	"sort"
+)
+
+// Iterator walks records in ascending key order, including tombstones. Key
+// and Value are only valid until the next call to Next.
+type Iterator interface {
+	Next() bool
+	Key() string
+	Value() []byte
+	Kind() Kind
+	Err() error
+	Close() error
+}
+
+type tableIterator struct {
+	t       *SSTable
+	f       readFile
+	release func()
+	ro      ReadOptions
+	// Records outside [start, end) are skipped; an empty end is unbounded.
+	start string
+	end   string
+	block int
+	buf   []byte
+	key   string
+	val   []byte
+	kind  Kind
+	err   error
+}
+
+// NewIterator returns an iterator over every record in the table. It reads
+// one data block at a time.
+func (t *SSTable) NewIterator() (Iterator, error) {
+	return t.NewIteratorWithOptions(DefaultReadOptions())
+}
+
+// NewIteratorWithOptions is NewIterator with control over the block cache.
+func (t *SSTable) NewIteratorWithOptions(ro ReadOptions) (Iterator, error) {
+	f, release, err := t.file()
+	if err != nil {
+		return nil, err
+	}
+	return &tableIterator{t: t, f: f, release: release, ro: ro}, nil
+}
+
+// NewRangeIterator returns an iterator over the records with keys in
+// [start, end). An empty end means no upper bound.
+func (t *SSTable) NewRangeIterator(start, end string, ro ReadOptions) (Iterator, error) {
+	f, release, err := t.file()
+	if err != nil {
+		return nil, err
+	}
+	// Start at the last block whose first key is <= start.
+	block := max(sort.Search(len(t.index), func(i int) bool {
+		return t.index[i].firstKey > start
+	})-1, 0)
+	return &tableIterator{t: t, f: f, release: release, ro: ro, start: start, end: end, block: block}, nil
+}
+
+func (it *tableIterator) Next() bool {
+	for it.next() {
+		switch {
+		case it.key < it.start:
+		case it.end != "" && it.key >= it.end:
+			it.block, it.buf = len(it.t.index), nil
+			return false
+		default:
+			return true
+		}
+	}
+	return false
+}
+
+func (it *tableIterator) next() bool {
+	if it.err != nil {
+		return false
+	}
+	for len(it.buf) == 0 {
+		if it.block >= len(it.t.index) {
+			return false
+		}
+		h := it.t.index[it.block].handle
+		if block, hit := it.t.cachedBlock(h); hit {
+			it.buf = block
+		} else {
+			if it.buf, it.err = readDataBlock(it.f, h, it.t.codec); it.err != nil {
+				return false
+			}
+			it.t.fillCache(h, it.buf, it.ro)
+		}
+		it.block++
+	}
+	var err error
+	it.key, it.val, it.kind, it.buf, err = decodeRecord(it.buf)
+	if err != nil {
+		it.err = corruption(it.t.Path, int64(it.t.index[it.block-1].handle.offset), err.Error())
+		return false
+	}
+	return true
+}
+
+func (it *tableIterator) Key() string   { return it.key }
+func (it *tableIterator) Value() []byte { return it.val }
+func (it *tableIterator) Kind() Kind    { return it.kind }
+func (it *tableIterator) Err() error    { return it.err }
+func (it *tableIterator) Close() error {
+	if it.release != nil {
+		it.release()
+		it.release = nil
+	}
+	return nil
+}
+
+// mergingIterator merges several sorted iterators into one. When more than
+// one input holds the same key only the record from the newest input is
+// returned; inputs are ranked by their position, later meaning newer.
+type mergingIterator struct {
+	iters   []Iterator
+	h       iterHeap
+	cur     *heapItem
+	started bool
+	err     error
+}
+
+type heapItem struct {
+	it   Iterator
+	rank int
+}
+
+type iterHeap []*heapItem
+
+func (h iterHeap) Len() int { return len(h) }
+func (h iterHeap) Less(i, j int) bool {
+	ki, kj := h[i].it.Key(), h[j].it.Key()
+	if ki != kj {
+		return ki < kj
+	}
+	return h[i].rank > h[j].rank
+}
+func (h iterHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *iterHeap) Push(x any)   { *h = append(*h, x.(*heapItem)) }
+func (h *iterHeap) Pop() any {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
+
+// NewMergingIterator merges iters, which are ordered oldest first.
+func NewMergingIterator(iters ...Iterator) Iterator {
+	return &mergingIterator{iters: iters}
+}
+
+func (m *mergingIterator) advance(item *heapItem) {
+	if item.it.Next() {
+		heap.Push(&m.h, item)
+	} else if err := item.it.Err(); err != nil && m.err == nil {
+		m.err = err
+	}
+}
+
+func (m *mergingIterator) Next() bool {
+	if !m.started {
+		m.started = true
+		for i, it := range m.iters {
+			m.advance(&heapItem{it: it, rank: i})
+		}
+	} else if m.cur != nil {
+		m.advance(m.cur)
+		m.cur = nil
+	}
+	if m.err != nil || m.h.Len() == 0 {
+		return false
+	}
+
+	m.cur = heap.Pop(&m.h).(*heapItem)
+	key := m.cur.it.Key()
+	for m.h.Len() > 0 && m.h[0].it.Key() == key {
+		m.advance(heap.Pop(&m.h).(*heapItem))
+	}
+	return m.err == nil
+}
+
+func (m *mergingIterator) Key() string   { return m.cur.it.Key() }
+func (m *mergingIterator) Value() []byte { return m.cur.it.Value() }
+func (m *mergingIterator) Kind() Kind    { return m.cur.it.Kind() }
+func (m *mergingIterator) Err() error    { return m.err }
+
+func (m *mergingIterator) Close() error {
+	var errs []error
+	for _, it := range m.iters {
+		errs = append(errs, it.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// MergeSSTables streams the tables at inputs, ordered oldest first, into a
+// single table at outPath. Newer records shadow older ones and tombstones
+// are dropped, so inputs must include the oldest table that could hold any
+// key they delete.
+func MergeSSTables(outPath string, inputs []string, opts Options) error {
+	var iters []Iterator
+	defer func() {
+		for _, it := range iters {
+			it.Close()
+		}
+	}()
+	var smallestSeq, largestSeq uint64
+	for _, path := range inputs {
+		t, err := OpenSSTable(path)
+		if err != nil {
+			return err
+		}
+		p := t.Properties()
+		if p.NumEntries == 0 {
+			continue
+		}
+		if p.LargestSeq != 0 {
+			if smallestSeq == 0 || p.SmallestSeq < smallestSeq {
+				smallestSeq = p.SmallestSeq
+			}
+			largestSeq = max(largestSeq, p.LargestSeq)
+		}
+		it, err := t.NewIterator()
+		if err != nil {
+			return err
+		}
+		iters = append(iters, it)
+	}
+	merged := NewMergingIterator(iters...)
+
+	tw, err := NewWriter(outPath, opts)
+	if err != nil {
+		return err
+	}
+	tw.SetSeqRange(smallestSeq, largestSeq)
+
+	for merged.Next() {
+		if merged.Kind() == KindDelete {
+			continue
+		}
+		if err := tw.Add(merged.Key(), merged.Value(), KindPut); err != nil {
+			tw.Abort()
+			return err
+		}
+	}
+	if err := merged.Err(); err != nil {
+		tw.Abort()
+		return err
+	}
+	return tw.Finish()
+}
@@ -0,0 +1,78 @@
+package SSTables
+
+import (
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// mergeInputs returns three tables, oldest first, that overwrite and
+// delete each other's keys.
+func mergeInputs(t *testing.T) []string {
+	return []string{
+		writeTestTable(t, DefaultOptions(), []testRecord{{key: "a", val: "1"}, {key: "b", val: "1"}, {key: "c", val: "1"}, {key: "d", val: "1"}}),
+		writeTestTable(t, DefaultOptions(), []testRecord{{key: "b", kind: KindDelete}, {key: "c", val: "2"}}),
+		writeTestTable(t, DefaultOptions(), []testRecord{{key: "a", val: "3"}, {key: "e", val: "3"}}),
+	}
+}
+
+// collect drains it into records.
+func collect(t *testing.T, it Iterator) []testRecord {
+	t.Helper()
+	defer it.Close()
+	var recs []testRecord
+	for it.Next() {
+		recs = append(recs, testRecord{key: it.Key(), val: string(it.Value()), kind: it.Kind()})
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return recs
+}
+
+func TestMergingIteratorPrecedence(t *testing.T) {
+	var iters []Iterator
+	for _, path := range mergeInputs(t) {
+		it, err := openTestTable(t, path).NewIterator()
+		if err != nil {
+			t.Fatal(err)
+		}
+		iters = append(iters, it)
+	}
+	got := collect(t, NewMergingIterator(iters...))
+	want := []testRecord{
+		{key: "a", val: "3"},
+		{key: "b", kind: KindDelete},
+		{key: "c", val: "2"},
+		{key: "d", val: "1"},
+		{key: "e", val: "3"},
+	}
+	if !slices.Equal(got, want) {
+		t.Fatalf("merged %v, want %v", got, want)
+	}
+}
+
+func TestMergeSSTablesDropsTombstones(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "merged.sst")
+	if err := MergeSSTables(out, mergeInputs(t), DefaultOptions()); err != nil {
+		t.Fatal(err)
+	}
+	tbl := openTestTable(t, out)
+	it, err := tbl.NewIterator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := collect(t, it)
+	want := []testRecord{
+		{key: "a", val: "3"},
+		{key: "c", val: "2"},
+		{key: "d", val: "1"},
+		{key: "e", val: "3"},
+	}
+	if !slices.Equal(got, want) {
+		t.Fatalf("merged %v, want %v", got, want)
+	}
+	if _, _, ok, err := tbl.Get("b"); err != nil || ok {
+		t.Fatalf("deleted key survived the merge: %v, %v", ok, err)
+	}
+}
@@ -0,0 +1,18 @@
+//go:build !unix
+
+package SSTables
+
+import (
+	"errors"
+	"os"
+)
+
+var errMmapUnsupported = errors.New("sstable: mmap is not supported on this platform")
+
+func mmap(f *os.File, size int64) ([]byte, error) {
+	return nil, errMmapUnsupported
+}
+
+func munmap(b []byte) error {
+	return nil
+}
@@ -0,0 +1,100 @@
+package SSTables
+
+import (
+	"encoding/binary"
+)
+
+// Properties summarises a table. They are gathered while the table is written
+// and stored in its properties block, so they can be read without scanning
+// the data.
+type Properties struct {
+	SmallestKey   string
+	LargestKey    string
+	NumEntries    uint64
+	NumTombstones uint64
+	// RawSize and CompressedSize are the total size of the data blocks
+	// before and after compression.
+	RawSize        uint64
+	CompressedSize uint64
+	// SmallestSeq and LargestSeq bound the sequence numbers of the writes
+	// the table holds. Both are zero when the writer did not supply them.
+	SmallestSeq uint64
+	LargestSeq  uint64
+}
+
+// Contains reports whether key falls inside the table's key range.
+func (p Properties) Contains(key string) bool {
+	return p.NumEntries > 0 && key >= p.SmallestKey && key <= p.LargestKey
+}
+
+// Overlaps reports whether the table's key range intersects
+// [smallest, largest].
+func (p Properties) Overlaps(smallest, largest string) bool {
+	return p.NumEntries > 0 && smallest <= p.LargestKey && largest >= p.SmallestKey
+}
+
+func (p Properties) encode() []byte {
+	var buf []byte
+	for _, k := range []string{p.SmallestKey, p.LargestKey} {
+		buf = binary.AppendUvarint(buf, uint64(len(k)))
+		buf = append(buf, k...)
+	}
+	for _, v := range []uint64{p.NumEntries, p.NumTombstones, p.RawSize, p.CompressedSize, p.SmallestSeq, p.LargestSeq} {
+		buf = binary.AppendUvarint(buf, v)
+	}
+	return buf
+}
+
+func decodeProperties(buf []byte) (Properties, error) {
+	var p Properties
+	for _, k := range []*string{&p.SmallestKey, &p.LargestKey} {
+		l, n := binary.Uvarint(buf)
+		if n <= 0 || uint64(len(buf)-n) < l {
+			return Properties{}, errBadBlock
+		}
+		*k = string(buf[n : n+int(l)])
+		buf = buf[n+int(l):]
+	}
+	for _, v := range []*uint64{&p.NumEntries, &p.NumTombstones, &p.RawSize, &p.CompressedSize, &p.SmallestSeq, &p.LargestSeq} {
+		x, n := binary.Uvarint(buf)
+		if n <= 0 {
+			return Properties{}, errBadBlock
+		}
+		*v = x
+		buf = buf[n:]
+	}
+	return p, nil
+}
+
+// Properties returns the table's properties.
+func (t *SSTable) Properties() Properties {
+	return t.props
+}
+
+// ReadProperties reads only the footer and properties block of the table at
+// path.
+func ReadProperties(path string) (Properties, error) {
+	f, err := openFile(path, false)
+	if err != nil {
+		return Properties{}, err
+	}
+	defer f.Close()
+
+	ft, err := readFooter(f)
+	if err != nil {
+		return Properties{}, err
+	}
+	return readProperties(f, ft.props)
+}
+
+func readProperties(f readFile, h blockHandle) (Properties, error) {
+	buf, err := readBlock(f, h)
+	if err != nil {
+		return Properties{}, err
+	}
+	p, err := decodeProperties(buf)
+	if err != nil {
+		return Properties{}, corruption(f.Name(), int64(h.offset), "malformed properties block")
+	}
+	return p, nil
+}
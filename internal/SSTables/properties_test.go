@@ -0,0 +1,85 @@
+package SSTables
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestProperties(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "000001.sst")
+	opts := DefaultOptions()
+	opts.Codec = FlateCompression
+	data := map[string]Entry{
+		"b": {Kind: KindPut, Value: []byte("1")},
+		"d": {Kind: KindDelete},
+		"f": {Kind: KindPut, Value: []byte("2")},
+	}
+	if err := WriteSSTable(path, data, opts); err != nil {
+		t.Fatal(err)
+	}
+	p, err := ReadProperties(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.SmallestKey != "b" || p.LargestKey != "f" || p.NumEntries != 3 || p.NumTombstones != 1 {
+		t.Fatalf("properties %+v, want keys b-f, 3 entries, 1 tombstone", p)
+	}
+	if p.RawSize == 0 || p.CompressedSize == 0 {
+		t.Fatalf("properties %+v, want block sizes", p)
+	}
+	if p != openTestTable(t, path).Properties() {
+		t.Fatal("ReadProperties disagrees with the open table")
+	}
+
+	for _, tt := range []struct {
+		smallest, largest string
+		want              bool
+	}{
+		{"a", "a", false},
+		{"a", "b", true},
+		{"c", "e", true},
+		{"f", "z", true},
+		{"g", "z", false},
+	} {
+		if got := p.Overlaps(tt.smallest, tt.largest); got != tt.want {
+			t.Errorf("Overlaps(%s, %s) = %v, want %v", tt.smallest, tt.largest, got, tt.want)
+		}
+		if tt.smallest == tt.largest && p.Contains(tt.smallest) != tt.want {
+			t.Errorf("Contains(%s) = %v, want %v", tt.smallest, !tt.want, tt.want)
+		}
+	}
+	if (Properties{}).Contains("") || (Properties{}).Overlaps("", "z") {
+		t.Error("an empty table claims keys")
+	}
+}
+
+func TestMergeSSTablesSeqRange(t *testing.T) {
+	var inputs []string
+	for i, seqs := range [][2]uint64{{5, 9}, {0, 0}, {2, 4}} {
+		path := filepath.Join(t.TempDir(), "in.sst")
+		w, err := NewWriter(path, DefaultOptions())
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.SetSeqRange(seqs[0], seqs[1])
+		if err := w.Add(string(rune('a'+i)), []byte("v"), KindPut); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Finish(); err != nil {
+			t.Fatal(err)
+		}
+		inputs = append(inputs, path)
+	}
+	out := filepath.Join(t.TempDir(), "merged.sst")
+	if err := MergeSSTables(out, inputs, DefaultOptions()); err != nil {
+		t.Fatal(err)
+	}
+	p, err := ReadProperties(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A table without a range does not widen it.
+	if p.SmallestSeq != 2 || p.LargestSeq != 9 {
+		t.Fatalf("merged seqs %d-%d, want 2-9", p.SmallestSeq, p.LargestSeq)
+	}
+}
@@ -3,129 +3,577 @@ package SSTables
 
 import (
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
 	"os"
+	"slices"
 	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/Aswin-Sk/MinionDB/internal/fileformat"
+)
+
+// Kind distinguishes live values from deletions. A delete record is kept
+// as a tombstone so that it shadows older tables holding the same key.
+type Kind byte
+
+const (
+	KindPut Kind = iota
+	KindDelete
+)
+
+// Entry is the value side of a record.
+type Entry struct {
+	Kind  Kind
+	Value []byte
+}
+
+// Table layout:
+//
+//	[data block 0] ... [data block N-1] [filter block] [properties block]
+//	[index block] [footer] [stamp]
+//
+// A data block holds sorted records of the form
+// [kind u8][klen u32][vlen u32][key][value] and is cut once it grows past
+// blockSize. Delete records carry an empty value.
+// The filter block is a Bloom filter over every key in the table and the
+// properties block is an encoded Properties. The index block holds one entry
+// per data block, [klen u32][first key][offset u64][size u32], and the
+// fixed-size footer holds the handles of the filter, properties and index
+// blocks followed by the ID of the codec used for the data blocks.
+//
+// Every block is followed by a 4-byte CRC32C of its stored (possibly
+// compressed) contents, and the footer ends with a CRC32C of the fields that
+// precede it. Block handles do not include the trailer. Only data blocks are
+// compressed; the filter and index blocks are always stored raw. The file
+// ends with a fileformat stamp; tables written before it was introduced end
+// at the footer and are rejected as legacy.
+const (
+	blockSize        = 4 << 10
+	blockTrailerSize = 4
+	footerSize       = 41
 )
 
-const Tombstone = "__deleted__"
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+var errBadBlock = errors.New("malformed block")
+
+var nextTableID atomic.Uint64
 
+// Options controls how tables are written.
+type Options struct {
+	// BloomFalsePositiveRate is the target false-positive rate of the
+	// per-table Bloom filter. Zero disables the filter.
+	BloomFalsePositiveRate float64
+	// Codec compresses data blocks. Nil means NoCompression.
+	Codec Codec
+}
+
+func DefaultOptions() Options {
+	return Options{BloomFalsePositiveRate: 0.01, Codec: NoCompression}
+}
+
+// SSTable is an open table whose index and filter are held in memory, so a
+// lookup touches at most one data block on disk.
+//
+// A table is reference counted. It starts with one reference, owned by
+// whoever opened it; readers that may outlive that owner's use take their
+// own with Ref. Once MarkObsolete has been called, dropping the last
+// reference removes the file.
 type SSTable struct {
-	Path string
+	Path   string
+	index  []indexEntry
+	filter *bloomFilter
+	codec  Codec
+	props  Properties
+	// cache serves the table's file. Without one, every read opens the
+	// file itself.
+	cache *TableCache
+	// blocks, if set, caches the table's data blocks under id, which is
+	// unique to this open table.
+	blocks   *BlockCache
+	id       uint64
+	refs     atomic.Int32
+	obsolete atomic.Bool
 }
 
-func WriteSSTable(path string, data map[string][]byte) error {
-	keys := make([]string, 0, len(data))
-	for k := range data {
-		keys = append(keys, k)
-	}
-	sort.Strings(keys)
+type blockHandle struct {
+	offset uint64
+	size   uint32
+}
+
+type indexEntry struct {
+	firstKey string
+	handle   blockHandle
+}
 
-	f, err := os.Create(path)
+type footer struct {
+	filter blockHandle
+	props  blockHandle
+	index  blockHandle
+	codec  byte
+}
+
+// OpenSSTable loads the index and filter of the table at path. The file is
+// reopened for every read; use a TableCache to keep it open.
+func OpenSSTable(path string) (*SSTable, error) {
+	return openSSTable(path, nil)
+}
+
+func openSSTable(path string, cache *TableCache) (*SSTable, error) {
+	t := &SSTable{Path: path, cache: cache, id: nextTableID.Add(1)}
+	if cache != nil {
+		t.blocks = cache.blocks
+	}
+	t.refs.Store(1)
+	f, release, err := t.file()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer f.Close()
+	defer release()
 
-	for _, k := range keys {
-		v := data[k]
-		var klen, vlen [4]byte
-		binary.LittleEndian.PutUint32(klen[:], uint32(len(k)))
-		binary.LittleEndian.PutUint32(vlen[:], uint32(len(v)))
-		f.Write(klen[:])
-		f.Write(vlen[:])
-		f.Write([]byte(k))
-		f.Write(v)
+	ft, err := readFooter(f)
+	if err != nil {
+		return nil, err
 	}
-	return nil
+	if t.codec, err = footerCodec(f, ft); err != nil {
+		return nil, err
+	}
+	if t.index, err = readIndex(f, ft.index); err != nil {
+		return nil, err
+	}
+	if t.props, err = readProperties(f, ft.props); err != nil {
+		return nil, err
+	}
+	if ft.filter.size > 0 {
+		buf, err := readBlock(f, ft.filter)
+		if err != nil {
+			return nil, err
+		}
+		if t.filter, err = decodeBloomFilter(buf); err != nil {
+			return nil, corruption(path, int64(ft.filter.offset), "malformed filter block")
+		}
+	}
+	return t, nil
 }
 
-func ReadSSTable(path string, key string) ([]byte, bool, error) {
-	f, err := os.Open(path)
+// file returns the table's file and a function to call once done with it.
+func (t *SSTable) file() (readFile, func(), error) {
+	if t.cache == nil {
+		f, err := openFile(t.Path, false)
+		if err != nil {
+			return nil, nil, err
+		}
+		return f, func() { f.Close() }, nil
+	}
+	cf, err := t.cache.acquire(t.Path)
 	if err != nil {
-		return nil, false, err
+		return nil, nil, err
 	}
-	defer f.Close()
+	return cf.f, func() { t.cache.release(cf) }, nil
+}
 
-	var klenBuf, vlenBuf [4]byte
-	for {
-		_, err := f.Read(klenBuf[:])
+// Ref adds a reference to the table.
+func (t *SSTable) Ref() {
+	t.refs.Add(1)
+}
+
+// Unref drops a reference. Dropping the last one of an obsolete table
+// evicts it from its cache and removes its file.
+func (t *SSTable) Unref() error {
+	if t.refs.Add(-1) > 0 || !t.obsolete.Load() {
+		return nil
+	}
+	if t.cache != nil {
+		t.cache.Evict(t.Path)
+	}
+	return os.Remove(t.Path)
+}
+
+// MarkObsolete schedules the table's file for removal once it is no longer
+// referenced.
+func (t *SSTable) MarkObsolete() {
+	t.obsolete.Store(true)
+}
+
+// MayContain reports whether key can be present in the table. A false
+// result is definitive.
+func (t *SSTable) MayContain(key string) bool {
+	return t.filter == nil || t.filter.mayContain(key)
+}
+
+// Get looks key up in the table. A found delete record is returned with
+// ok set and kind KindDelete, since it is authoritative over older tables.
+func (t *SSTable) Get(key string) ([]byte, Kind, bool, error) {
+	return t.GetWithOptions(key, DefaultReadOptions())
+}
+
+// GetWithOptions is Get with control over the block cache.
+func (t *SSTable) GetWithOptions(key string, ro ReadOptions) (val []byte, kind Kind, ok bool, err error) {
+	if !t.props.Contains(key) || !t.MayContain(key) {
+		return nil, 0, false, nil
+	}
+
+	// Find the last block whose first key is <= key.
+	i := sort.Search(len(t.index), func(i int) bool {
+		return t.index[i].firstKey > key
+	}) - 1
+	if i < 0 {
+		return nil, 0, false, nil
+	}
+
+	h := t.index[i].handle
+	block, hit := t.cachedBlock(h)
+	if !hit {
+		f, release, err := t.file()
 		if err != nil {
-			break
+			return nil, 0, false, err
 		}
-		_, _ = f.Read(vlenBuf[:])
-		klen := binary.LittleEndian.Uint32(klenBuf[:])
-		vlen := binary.LittleEndian.Uint32(vlenBuf[:])
+		defer release()
 
-		kb := make([]byte, klen)
-		_, err = f.Read(kb)
+		bufp := blockPool.Get().(*[]byte)
+		defer blockPool.Put(bufp)
+		stored, err := readBlockInto(f, h, bufp)
 		if err != nil {
-			break
+			return nil, 0, false, err
 		}
-		vb := make([]byte, vlen)
-		_, err = f.Read(vb)
-		if err != nil {
-			break
+		if block, err = t.codec.Decode(stored); err != nil {
+			return nil, 0, false, corruption(t.Path, int64(h.offset), "decompress: "+err.Error())
 		}
-		if string(kb) == key {
-			return vb, true, nil
+		t.fillCache(h, block, ro)
+	}
+	val, kind, ok, err = seekBlock(block, key)
+	if err != nil {
+		return nil, 0, false, corruption(t.Path, int64(h.offset), err.Error())
+	}
+	if ok {
+		// The block may be pooled or mapped, so the value is copied out.
+		val = append([]byte(nil), val...)
+	}
+	return val, kind, ok, nil
+}
+
+func (t *SSTable) cachedBlock(h blockHandle) ([]byte, bool) {
+	if t.blocks == nil {
+		return nil, false
+	}
+	return t.blocks.get(blockKey{table: t.id, offset: h.offset})
+}
+
+// fillCache caches a copy of block, which may alias a pooled buffer or a
+// mapped file.
+func (t *SSTable) fillCache(h blockHandle, block []byte, ro ReadOptions) {
+	if t.blocks != nil && ro.FillCache {
+		t.blocks.insert(blockKey{table: t.id, offset: h.offset}, slices.Clone(block))
+	}
+}
+
+// blockPool holds read buffers for Get, which copies out the one value it
+// needs and can hand its buffer back straight away.
+var blockPool = sync.Pool{
+	New: func() any {
+		b := make([]byte, 0, blockSize+blockTrailerSize)
+		return &b
+	},
+}
+
+// seekBlock finds key in block without materialising the keys it passes.
+func seekBlock(block []byte, key string) ([]byte, Kind, bool, error) {
+	for len(block) > 0 {
+		if len(block) < 9 {
+			return nil, 0, false, errBadBlock
 		}
+		kind := Kind(block[0])
+		if kind != KindPut && kind != KindDelete {
+			return nil, 0, false, errBadBlock
+		}
+		klen := binary.LittleEndian.Uint32(block[1:5])
+		vlen := binary.LittleEndian.Uint32(block[5:9])
+		block = block[9:]
+		if uint64(len(block)) < uint64(klen)+uint64(vlen) {
+			return nil, 0, false, errBadBlock
+		}
+		k := block[:klen]
+		switch {
+		case string(k) == key:
+			return block[klen : klen+vlen], kind, true, nil
+		case string(k) > key:
+			return nil, 0, false, nil
+		}
+		block = block[klen+vlen:]
 	}
-	return nil, false, nil
+	return nil, 0, false, nil
 }
 
-func MergeSSTables(outPath string, sst1, sst2 string) error {
-	f1, err := os.Open(sst1)
+func ReadSSTable(path string, key string) ([]byte, Kind, bool, error) {
+	t, err := OpenSSTable(path)
 	if err != nil {
-		return err
+		return nil, 0, false, err
 	}
-	defer f1.Close()
+	return t.Get(key)
+}
+
+func encodeIndex(index []indexEntry) []byte {
+	var buf []byte
+	var scratch [8]byte
+	for _, e := range index {
+		binary.LittleEndian.PutUint32(scratch[:4], uint32(len(e.firstKey)))
+		buf = append(buf, scratch[:4]...)
+		buf = append(buf, e.firstKey...)
+		binary.LittleEndian.PutUint64(scratch[:], e.handle.offset)
+		buf = append(buf, scratch[:]...)
+		binary.LittleEndian.PutUint32(scratch[:4], e.handle.size)
+		buf = append(buf, scratch[:4]...)
+	}
+	return buf
+}
+
+func (h blockHandle) put(b []byte) {
+	binary.LittleEndian.PutUint64(b[0:8], h.offset)
+	binary.LittleEndian.PutUint32(b[8:12], h.size)
+}
 
-	f2, err := os.Open(sst2)
+func getBlockHandle(b []byte) blockHandle {
+	return blockHandle{
+		offset: binary.LittleEndian.Uint64(b[0:8]),
+		size:   binary.LittleEndian.Uint32(b[8:12]),
+	}
+}
+
+func (ft footer) encode() []byte {
+	b := make([]byte, footerSize)
+	ft.filter.put(b[0:12])
+	ft.props.put(b[12:24])
+	ft.index.put(b[24:36])
+	b[36] = ft.codec
+	binary.LittleEndian.PutUint32(b[37:41], crc32.Checksum(b[:37], castagnoli))
+	return b
+}
+
+func readFooter(f readFile) (footer, error) {
+	end := f.Size() - fileformat.StampSize
+	var stamp [fileformat.StampSize]byte
+	if end >= 0 {
+		if _, err := f.ReadAt(stamp[:], end); err != nil {
+			return footer{}, err
+		}
+	}
+	if !fileformat.HasMagic(stamp[:], fileformat.TableMagic) {
+		_, err := readFooterAt(f, f.Size())
+		return footer{}, fileformat.Check(f.Name(), stamp[:], fileformat.TableMagic, fileformat.TableVersion, err == nil)
+	}
+	if err := fileformat.Check(f.Name(), stamp[:], fileformat.TableMagic, fileformat.TableVersion, false); err != nil {
+		return footer{}, err
+	}
+	return readFooterAt(f, end)
+}
+
+// readFooterAt reads the footer that ends at end.
+func readFooterAt(f readFile, end int64) (footer, error) {
+	footerOffset := end - footerSize
+	if footerOffset < 0 {
+		return footer{}, corruption(f.Name(), 0, "file too short for footer")
+	}
+	var b [footerSize]byte
+	if _, err := f.ReadAt(b[:], footerOffset); err != nil {
+		return footer{}, err
+	}
+	if crc32.Checksum(b[:37], castagnoli) != binary.LittleEndian.Uint32(b[37:41]) {
+		return footer{}, corruption(f.Name(), footerOffset, "footer checksum mismatch")
+	}
+	ft := footer{
+		filter: getBlockHandle(b[0:12]),
+		props:  getBlockHandle(b[12:24]),
+		index:  getBlockHandle(b[24:36]),
+		codec:  b[36],
+	}
+	limit := uint64(footerOffset)
+	for _, h := range []blockHandle{ft.filter, ft.props, ft.index} {
+		if h.offset+uint64(h.size) > limit {
+			return footer{}, corruption(f.Name(), footerOffset, "block handle out of range")
+		}
+	}
+	return ft, nil
+}
+
+func footerCodec(f readFile, ft footer) (Codec, error) {
+	codec, ok := codecByID(ft.codec)
+	if !ok {
+		return nil, fmt.Errorf("sstable: %s uses unknown codec id %d", f.Name(), ft.codec)
+	}
+	return codec, nil
+}
+
+func readIndex(f readFile, h blockHandle) ([]indexEntry, error) {
+	buf, err := readBlock(f, h)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer f2.Close()
 
-	data := make(map[string][]byte)
+	var index []indexEntry
+	for len(buf) > 0 {
+		if len(buf) < 4 {
+			return nil, corruption(f.Name(), int64(h.offset), "malformed index block")
+		}
+		klen := binary.LittleEndian.Uint32(buf)
+		buf = buf[4:]
+		if uint64(len(buf)) < uint64(klen)+12 {
+			return nil, corruption(f.Name(), int64(h.offset), "malformed index block")
+		}
+		e := indexEntry{firstKey: string(buf[:klen])}
+		buf = buf[klen:]
+		e.handle.offset = binary.LittleEndian.Uint64(buf)
+		e.handle.size = binary.LittleEndian.Uint32(buf[8:])
+		buf = buf[12:]
+		index = append(index, e)
+	}
+	return index, nil
+}
 
-	readAll := func(f *os.File) error {
-		var klenBuf, vlenBuf [4]byte
-		for {
-			_, err := f.Read(klenBuf[:])
-			if err != nil {
-				break
-			}
-			_, _ = f.Read(vlenBuf[:])
-			klen := binary.LittleEndian.Uint32(klenBuf[:])
-			vlen := binary.LittleEndian.Uint32(vlenBuf[:])
-
-			kb := make([]byte, klen)
-			_, err = f.Read(kb)
-			if err != nil {
-				return err
-			}
-			vb := make([]byte, vlen)
-			_, err = f.Read(vb)
-			if err != nil {
-				return err
+// readBlock reads the block at h and verifies its checksum.
+func readBlock(f readFile, h blockHandle) ([]byte, error) {
+	return readBlockInto(f, h, new([]byte))
+}
+
+// readBlockInto is readBlock reading into *buf, which is grown as needed.
+// A mapped file is read in place and *buf is left untouched.
+func readBlockInto(f readFile, h blockHandle, buf *[]byte) ([]byte, error) {
+	n := int64(h.size) + blockTrailerSize
+	var b []byte
+	if m, ok := f.(*mmapFile); ok {
+		if b, ok = m.bytes(int64(h.offset), n); !ok {
+			return nil, corruption(f.Name(), int64(h.offset), "truncated block")
+		}
+	} else {
+		if int64(cap(*buf)) < n {
+			*buf = make([]byte, n)
+		}
+		b = (*buf)[:n]
+		if _, err := f.ReadAt(b, int64(h.offset)); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil, corruption(f.Name(), int64(h.offset), "truncated block")
 			}
+			return nil, err
+		}
+	}
+	block := b[:h.size]
+	if crc32.Checksum(block, castagnoli) != binary.LittleEndian.Uint32(b[h.size:]) {
+		return nil, corruption(f.Name(), int64(h.offset), "block checksum mismatch")
+	}
+	return block, nil
+}
+
+// readDataBlock reads the data block at h and decompresses it with codec.
+func readDataBlock(f readFile, h blockHandle, codec Codec) ([]byte, error) {
+	stored, err := readBlock(f, h)
+	if err != nil {
+		return nil, err
+	}
+	block, err := codec.Decode(stored)
+	if err != nil {
+		return nil, corruption(f.Name(), int64(h.offset), "decompress: "+err.Error())
+	}
+	return block, nil
+}
 
-			data[string(kb)] = vb
+// scanBlock calls fn for every record in block, in key order, until fn
+// returns false.
+func scanBlock(block []byte, fn func(key string, val []byte, kind Kind) bool) error {
+	for len(block) > 0 {
+		k, v, kind, rest, err := decodeRecord(block)
+		if err != nil {
+			return err
+		}
+		block = rest
+		if !fn(k, v, kind) {
+			return nil
 		}
-		return nil
 	}
+	return nil
+}
 
-	if err := readAll(f1); err != nil {
-		return err
+func appendRecord(dst []byte, key string, val []byte, kind Kind) []byte {
+	var scratch [4]byte
+	dst = append(dst, byte(kind))
+	binary.LittleEndian.PutUint32(scratch[:], uint32(len(key)))
+	dst = append(dst, scratch[:]...)
+	binary.LittleEndian.PutUint32(scratch[:], uint32(len(val)))
+	dst = append(dst, scratch[:]...)
+	dst = append(dst, key...)
+	return append(dst, val...)
+}
+
+func decodeRecord(block []byte) (string, []byte, Kind, []byte, error) {
+	if len(block) < 9 {
+		return "", nil, 0, nil, errBadBlock
 	}
-	if err := readAll(f2); err != nil {
-		return err
+	kind := Kind(block[0])
+	if kind != KindPut && kind != KindDelete {
+		return "", nil, 0, nil, errBadBlock
 	}
+	klen := binary.LittleEndian.Uint32(block[1:5])
+	vlen := binary.LittleEndian.Uint32(block[5:9])
+	block = block[9:]
+	if uint64(len(block)) < uint64(klen)+uint64(vlen) {
+		return "", nil, 0, nil, errBadBlock
+	}
+	return string(block[:klen]), block[klen : klen+vlen], kind, block[klen+vlen:], nil
+}
 
-	for k, v := range data {
-		if string(v) == Tombstone {
-			delete(data, k)
+// legacyTombstone is the value that marked a deleted key in tables written
+// before records had kinds.
+const legacyTombstone = "__deleted__"
+
+// ScanRawTable calls fn, in key order, for each record of a table written
+// before tables had blocks: bare [klen u32][vlen u32][key][value] records
+// with nothing after them. Such a table has no stamp or footer for
+// UpgradeTable to find, so it has to be rewritten through a Writer.
+func ScanRawTable(path string, fn func(key string, val []byte, kind Kind) error) error {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	for off := 0; off < len(buf); {
+		if len(buf)-off < 8 {
+			return corruption(path, int64(off), "truncated record header")
 		}
+		klen := uint64(binary.LittleEndian.Uint32(buf[off:]))
+		vlen := uint64(binary.LittleEndian.Uint32(buf[off+4:]))
+		rec := buf[off+8:]
+		if uint64(len(rec)) < klen+vlen {
+			return corruption(path, int64(off), "truncated record")
+		}
+		key, val := string(rec[:klen]), rec[klen:klen+vlen]
+		kind := KindPut
+		if string(val) == legacyTombstone {
+			val, kind = nil, KindDelete
+		}
+		if err := fn(key, val, kind); err != nil {
+			return err
+		}
+		off += 8 + int(klen+vlen)
+	}
+	return nil
+}
+
+// UpgradeTable stamps a legacy table at path with the current format. It
+// reports whether the file needed upgrading.
+func UpgradeTable(path string) (bool, error) {
+	f, err := openFile(path, false)
+	if err != nil {
+		return false, err
+	}
+	_, err = readFooter(f)
+	f.Close()
+	switch {
+	case err == nil:
+		return false, nil
+	case !errors.Is(err, fileformat.ErrLegacyFormat):
+		return false, err
 	}
-	return WriteSSTable(outPath, data)
+	stamp := fileformat.Append(nil, fileformat.TableMagic, fileformat.TableVersion)
+	return true, fileformat.Rewrite(path, nil, stamp)
 }
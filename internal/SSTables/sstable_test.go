@@ -0,0 +1,128 @@
+package SSTables
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+// testRecord is a record to write into a test table.
+type testRecord struct {
+	key  string
+	val  string
+	kind Kind
+}
+
+// puts returns n live records with keys key-00000 onwards, enough for
+// several data blocks when n is in the hundreds.
+func puts(n int) []testRecord {
+	recs := make([]testRecord, n)
+	for i := range recs {
+		recs[i] = testRecord{key: fmt.Sprintf("key-%05d", i), val: fmt.Sprintf("value-%05d-%s", i, "padding-to-fill-blocks")}
+	}
+	return recs
+}
+
+// writeTestTable writes recs, which must be sorted, as a table and returns
+// its path.
+func writeTestTable(t *testing.T, opts Options, recs []testRecord) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "000001.sst")
+	w, err := NewWriter(path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range recs {
+		if err := w.Add(r.key, []byte(r.val), r.kind); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Finish(); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func openTestTable(t *testing.T, path string) *SSTable {
+	t.Helper()
+	tbl, err := OpenSSTable(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tbl
+}
+
+func TestTableRoundTrip(t *testing.T) {
+	recs := puts(500)
+	tbl := openTestTable(t, writeTestTable(t, DefaultOptions(), recs))
+	if len(tbl.index) < 2 {
+		t.Fatalf("table has %d data blocks, want several", len(tbl.index))
+	}
+	for _, r := range recs {
+		val, kind, ok, err := tbl.Get(r.key)
+		if err != nil || !ok || kind != KindPut || string(val) != r.val {
+			t.Fatalf("Get(%s) = %q, %v, %v, %v; want %q", r.key, val, kind, ok, err, r.val)
+		}
+	}
+	// Before the first key, between keys, in the gap at a block boundary
+	// and after the last key.
+	for _, key := range []string{"a", "key-00001x", tbl.index[1].firstKey + "\x00", "zzz"} {
+		if _, _, ok, err := tbl.Get(key); err != nil || ok {
+			t.Fatalf("Get(%s) found a missing key: %v", key, err)
+		}
+	}
+}
+
+func TestTableIterator(t *testing.T) {
+	recs := puts(500)
+	tbl := openTestTable(t, writeTestTable(t, DefaultOptions(), recs))
+
+	it, err := tbl.NewIterator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer it.Close()
+	i := 0
+	for ; it.Next(); i++ {
+		if it.Key() != recs[i].key || string(it.Value()) != recs[i].val {
+			t.Fatalf("record %d = %s=%q, want %s=%q", i, it.Key(), it.Value(), recs[i].key, recs[i].val)
+		}
+	}
+	if err := it.Err(); err != nil || i != len(recs) {
+		t.Fatalf("iterated %d records, %v; want %d", i, err, len(recs))
+	}
+
+	rit, err := tbl.NewRangeIterator(recs[100].key, recs[300].key, DefaultReadOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rit.Close()
+	i = 100
+	for ; rit.Next(); i++ {
+		if rit.Key() != recs[i].key {
+			t.Fatalf("range record = %s, want %s", rit.Key(), recs[i].key)
+		}
+	}
+	if err := rit.Err(); err != nil || i != 300 {
+		t.Fatalf("range ended at %d, %v; want 300", i, err)
+	}
+}
+
+func TestTableTombstones(t *testing.T) {
+	recs := []testRecord{
+		{key: "a", val: "1"},
+		{key: "b", kind: KindDelete},
+		// A value that once marked deletes is an ordinary value.
+		{key: "c", val: "__deleted__"},
+	}
+	tbl := openTestTable(t, writeTestTable(t, DefaultOptions(), recs))
+	for _, r := range recs {
+		val, kind, ok, err := tbl.Get(r.key)
+		if err != nil || !ok || kind != r.kind || string(val) != r.val {
+			t.Fatalf("Get(%s) = %q, %v, %v, %v; want %q, %v", r.key, val, kind, ok, err, r.val, r.kind)
+		}
+	}
+	if n := tbl.Properties().NumTombstones; n != 1 {
+		t.Fatalf("table counts %d tombstones, want 1", n)
+	}
+}
@@ -0,0 +1,221 @@
+package SSTables
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"sort"
+
+	"github.com/Aswin-Sk/MinionDB/internal/fileformat"
+)
+
+var (
+	ErrOutOfOrder   = errors.New("sstable: keys must be added in strictly ascending order")
+	ErrWriterClosed = errors.New("sstable: writer already finished or aborted")
+)
+
+// Writer streams records, which must arrive in strictly ascending key order,
+// into a new table. Only the current data block, the index and one hash per
+// key for the Bloom filter are held in memory, so tables of any size can be
+// built without first collecting them.
+type Writer struct {
+	path   string
+	f      *os.File
+	w      *blockWriter
+	opts   Options
+	codec  Codec
+	index  []indexEntry
+	block  []byte
+	first  string
+	hashes []uint64
+	props  Properties
+	closed bool
+}
+
+// NewWriter creates the table at path. The caller must end with either
+// Finish or Abort.
+func NewWriter(path string, opts Options) (*Writer, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	codec := opts.Codec
+	if codec == nil {
+		codec = NoCompression
+	}
+	return &Writer{
+		path:  path,
+		f:     f,
+		w:     &blockWriter{w: bufio.NewWriter(f)},
+		opts:  opts,
+		codec: codec,
+	}, nil
+}
+
+// Add appends a record. The value of a KindDelete record is ignored.
+func (tw *Writer) Add(key string, val []byte, kind Kind) error {
+	if tw.closed {
+		return ErrWriterClosed
+	}
+	if tw.props.NumEntries > 0 && key <= tw.props.LargestKey {
+		return fmt.Errorf("%w: %q after %q", ErrOutOfOrder, key, tw.props.LargestKey)
+	}
+	if kind == KindDelete {
+		val = nil
+	}
+	if len(tw.block) == 0 {
+		tw.first = key
+	}
+	if tw.filterEnabled() {
+		tw.hashes = append(tw.hashes, bloomHash(key))
+	}
+	if tw.props.NumEntries == 0 {
+		tw.props.SmallestKey = key
+	}
+	tw.props.LargestKey = key
+	tw.props.NumEntries++
+	if kind == KindDelete {
+		tw.props.NumTombstones++
+	}
+	tw.block = appendRecord(tw.block, key, val, kind)
+	if len(tw.block) >= blockSize {
+		return tw.flushBlock()
+	}
+	return nil
+}
+
+func (tw *Writer) flushBlock() error {
+	if len(tw.block) == 0 {
+		return nil
+	}
+	compressed, err := tw.codec.Encode(tw.block)
+	if err != nil {
+		return err
+	}
+	h, err := tw.w.writeBlock(compressed)
+	if err != nil {
+		return err
+	}
+	tw.index = append(tw.index, indexEntry{firstKey: tw.first, handle: h})
+	tw.props.RawSize += uint64(len(tw.block))
+	tw.props.CompressedSize += uint64(len(compressed))
+	tw.block = tw.block[:0]
+	return nil
+}
+
+// Finish writes the remaining blocks and the footer, syncs the file and
+// closes it. If it fails the partial file is removed.
+func (tw *Writer) Finish() (err error) {
+	if tw.closed {
+		return ErrWriterClosed
+	}
+	tw.closed = true
+	defer func() {
+		tw.f.Close()
+		if err != nil {
+			os.Remove(tw.path)
+		}
+	}()
+
+	if err := tw.flushBlock(); err != nil {
+		return err
+	}
+
+	var filterHandle blockHandle
+	if tw.filterEnabled() {
+		filter := newBloomFilter(len(tw.hashes), tw.opts.BloomFalsePositiveRate)
+		for _, h := range tw.hashes {
+			filter.add(h)
+		}
+		if filterHandle, err = tw.w.writeBlock(filter.encode()); err != nil {
+			return err
+		}
+	}
+	propsHandle, err := tw.w.writeBlock(tw.props.encode())
+	if err != nil {
+		return err
+	}
+	indexHandle, err := tw.w.writeBlock(encodeIndex(tw.index))
+	if err != nil {
+		return err
+	}
+
+	ft := footer{filter: filterHandle, props: propsHandle, index: indexHandle, codec: tw.codec.ID()}
+	if _, err := tw.w.w.Write(ft.encode()); err != nil {
+		return err
+	}
+	if _, err := tw.w.w.Write(fileformat.Append(nil, fileformat.TableMagic, fileformat.TableVersion)); err != nil {
+		return err
+	}
+	if err := tw.w.w.Flush(); err != nil {
+		return err
+	}
+	return tw.f.Sync()
+}
+
+// Abort discards the table and removes its file.
+func (tw *Writer) Abort() error {
+	if tw.closed {
+		return ErrWriterClosed
+	}
+	tw.closed = true
+	tw.f.Close()
+	return os.Remove(tw.path)
+}
+
+// SetSeqRange records the range of sequence numbers the table holds. It may
+// be called at any point before Finish.
+func (tw *Writer) SetSeqRange(smallest, largest uint64) {
+	tw.props.SmallestSeq = smallest
+	tw.props.LargestSeq = largest
+}
+
+func (tw *Writer) filterEnabled() bool {
+	return tw.opts.BloomFalsePositiveRate > 0 && tw.opts.BloomFalsePositiveRate < 1
+}
+
+// WriteSSTable writes data as a table at path. It sorts the keys first; use
+// a Writer directly when the records are already in order.
+func WriteSSTable(path string, data map[string]Entry, opts Options) error {
+	keys := make([]string, 0, len(data))
+	for k := range data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	tw, err := NewWriter(path, opts)
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		e := data[k]
+		if err := tw.Add(k, e.Value, e.Kind); err != nil {
+			tw.Abort()
+			return err
+		}
+	}
+	return tw.Finish()
+}
+
+// blockWriter appends checksummed blocks to a table file.
+type blockWriter struct {
+	w      *bufio.Writer
+	offset uint64
+}
+
+func (bw *blockWriter) writeBlock(b []byte) (blockHandle, error) {
+	h := blockHandle{offset: bw.offset, size: uint32(len(b))}
+	var trailer [blockTrailerSize]byte
+	binary.LittleEndian.PutUint32(trailer[:], crc32.Checksum(b, castagnoli))
+	if _, err := bw.w.Write(b); err != nil {
+		return blockHandle{}, err
+	}
+	if _, err := bw.w.Write(trailer[:]); err != nil {
+		return blockHandle{}, err
+	}
+	bw.offset += uint64(len(b)) + blockTrailerSize
+	return h, nil
+}
@@ -0,0 +1,90 @@
+package SSTables
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriterOrder(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "000001.sst")
+	w, err := NewWriter(path, DefaultOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Abort()
+	if err := w.Add("b", []byte("v"), KindPut); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"a", "b"} {
+		if err := w.Add(key, []byte("v"), KindPut); !errors.Is(err, ErrOutOfOrder) {
+			t.Fatalf("Add(%s) after b: got %v, want ErrOutOfOrder", key, err)
+		}
+	}
+	if err := w.Add("c", []byte("v"), KindPut); err != nil {
+		t.Fatalf("Add after a refused record: %v", err)
+	}
+}
+
+func TestWriterClosed(t *testing.T) {
+	path := writeTestTable(t, DefaultOptions(), nil)
+	if p := openTestTable(t, path).Properties(); p.NumEntries != 0 {
+		t.Fatalf("empty table holds %d entries", p.NumEntries)
+	}
+
+	w, err := NewWriter(filepath.Join(t.TempDir(), "000002.sst"), DefaultOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Finish(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Add("a", nil, KindPut); !errors.Is(err, ErrWriterClosed) {
+		t.Fatalf("Add after Finish: got %v, want ErrWriterClosed", err)
+	}
+	if err := w.Finish(); !errors.Is(err, ErrWriterClosed) {
+		t.Fatalf("second Finish: got %v, want ErrWriterClosed", err)
+	}
+	if err := w.Abort(); !errors.Is(err, ErrWriterClosed) {
+		t.Fatalf("Abort after Finish: got %v, want ErrWriterClosed", err)
+	}
+}
+
+func TestWriterAbort(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "000001.sst")
+	w, err := NewWriter(path, DefaultOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Add("a", []byte("v"), KindPut); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Abort(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("aborted table left behind: %v", err)
+	}
+}
+
+func TestWriterFailedFinishRemovesFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "000001.sst")
+	w, err := NewWriter(path, DefaultOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range puts(10) {
+		if err := w.Add(r.key, []byte(r.val), KindPut); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Every write from here on fails.
+	w.f.Close()
+	if err := w.Finish(); err == nil {
+		t.Fatal("Finish succeeded on a closed file")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("partial table left behind: %v", err)
+	}
+}
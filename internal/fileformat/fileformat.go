@@ -0,0 +1,166 @@
+// Package fileformat identifies the files MinionDB writes. Every file carries
+// a stamp of an 8-byte magic string naming its type followed by a u32 format
+// version: WALs, manifests and the transaction log start with it, SSTables
+// end with it.
+package fileformat
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+const StampSize = 12
+
+// Magic names a file type.
+type Magic string
+
+const (
+	TableMagic    Magic = "MNDB-SST"
+	WALMagic      Magic = "MNDB-WAL"
+	ManifestMagic Magic = "MNDB-MAN"
+	TxnLogMagic   Magic = "MNDB-TXN"
+)
+
+// Current format versions.
+const (
+	TableVersion    uint32 = 1
+	WALVersion      uint32 = 1
+	ManifestVersion uint32 = 3
+	TxnLogVersion   uint32 = 1
+)
+
+var (
+	// ErrLegacyFormat matches files written before files were stamped, or
+	// stamped with an older version. They can be converted with
+	// `miniondb upgrade`.
+	ErrLegacyFormat = errors.New("file predates format versioning; run 'miniondb upgrade'")
+	// ErrUnsupportedVersion matches files of a format version this build
+	// cannot read.
+	ErrUnsupportedVersion = errors.New("unsupported file format version")
+	// ErrBadMagic matches files that are not of the expected type.
+	ErrBadMagic = errors.New("not a MinionDB file of the expected type")
+)
+
+// Error reports a file that cannot be read because of its format.
+type Error struct {
+	Path string
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %v", e.Path, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Append appends the stamp of magic and version to dst.
+func Append(dst []byte, magic Magic, version uint32) []byte {
+	dst = append(dst, magic...)
+	return binary.LittleEndian.AppendUint32(dst, version)
+}
+
+// HasMagic reports whether b starts with the stamp of magic.
+func HasMagic(b []byte, magic Magic) bool {
+	return len(b) >= StampSize && string(b[:len(magic)]) == string(magic)
+}
+
+// Version returns the version in the stamp at the start of b, which must
+// hold one.
+func Version(b []byte) uint32 {
+	return binary.LittleEndian.Uint32(b[StampSize-4 : StampSize])
+}
+
+// OldestManifestVersion is the oldest manifest version that can still be
+// read without upgrading.
+const OldestManifestVersion uint32 = 1
+
+// Check validates the stamp at the start of b for the file at path. Older
+// versions than current are reported as ErrLegacyFormat and newer ones as
+// ErrUnsupportedVersion. A missing stamp is reported as ErrLegacyFormat if
+// the caller recognised the file as legacy, and as ErrBadMagic otherwise.
+func Check(path string, b []byte, magic Magic, current uint32, legacy bool) error {
+	return CheckRange(path, b, magic, current, current, legacy)
+}
+
+// CheckRange is Check for formats where versions from oldest up to current
+// can all be read.
+func CheckRange(path string, b []byte, magic Magic, oldest, current uint32, legacy bool) error {
+	if !HasMagic(b, magic) {
+		if legacy {
+			return &Error{Path: path, Err: ErrLegacyFormat}
+		}
+		return &Error{Path: path, Err: ErrBadMagic}
+	}
+	switch v := Version(b); {
+	case v < oldest:
+		return &Error{Path: path, Err: fmt.Errorf("%w (version %d, current %d)", ErrLegacyFormat, v, current)}
+	case v > current:
+		return &Error{Path: path, Err: fmt.Errorf("%w %d, newest known is %d", ErrUnsupportedVersion, v, current)}
+	}
+	return nil
+}
+
+// Rewrite replaces the file at path with prefix, its current contents and
+// suffix.
+func Rewrite(path string, prefix, suffix []byte) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	return Replace(path, func(w io.Writer) error {
+		if _, err := w.Write(prefix); err != nil {
+			return err
+		}
+		if _, err := io.Copy(w, src); err != nil {
+			return err
+		}
+		_, err := w.Write(suffix)
+		return err
+	})
+}
+
+// Replace replaces the file at path with whatever write produces. The new
+// file is written and synced under a temporary name first, so a crash
+// leaves either the old or the new file in place.
+func Replace(path string, write func(w io.Writer) error) error {
+	tmp := path + ".upgrade"
+	dst, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(dst)
+	err = write(bw)
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err == nil {
+		err = dst.Sync()
+	}
+	if err != nil {
+		dst.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
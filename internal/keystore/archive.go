@@ -0,0 +1,175 @@
+package keystore
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/Aswin-Sk/MinionDB/internal/fileformat"
+	"github.com/Aswin-Sk/MinionDB/internal/logger"
+)
+
+// archiveDir returns the directory the shard's segments are archived to, or
+// "" if archiving is off. Each shard has its own, named like its data
+// directory.
+func (db *MiniKV) archiveDir() string {
+	if db.opts.WALArchiveDir == "" {
+		return ""
+	}
+	return filepath.Join(db.opts.WALArchiveDir, filepath.Base(db.baseDirectory))
+}
+
+// archiveSealed archives, in the background, the segments no longer being
+// written to.
+func (db *MiniKV) archiveSealed() {
+	if db.archiveDir() == "" {
+		return
+	}
+	db.archiving.Add(1)
+	go func() {
+		defer db.archiving.Done()
+		db.walMu.RLock()
+		wb := db.wb
+		db.walMu.RUnlock()
+		if err := db.archiveWAL(wb.segment()); err != nil {
+			logger.Logger.Warn("archiving WAL", "path", db.baseDirectory, "error", err)
+		}
+	}()
+}
+
+// archiveWAL archives the segments numbered below below that are not
+// archived yet.
+func (db *MiniKV) archiveWAL(below uint64) error {
+	dir := db.archiveDir()
+	if dir == "" {
+		return nil
+	}
+	db.archiveMu.Lock()
+	defer db.archiveMu.Unlock()
+	nums, err := liveWALs(db.baseDirectory, 0)
+	if err != nil {
+		return err
+	}
+	for _, num := range nums {
+		if num >= below {
+			break
+		}
+		if err := archiveSegment(walFileName(db.baseDirectory, num), dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// archiveSegment copies the sealed segment at path into dir, unless a
+// complete copy is already there.
+func archiveSegment(path, dir string) error {
+	st, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	dst := filepath.Join(dir, filepath.Base(path))
+	if ast, err := os.Stat(dst); err == nil && ast.Size() == st.Size() {
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	return copyFile(path, dst)
+}
+
+// copyFile copies src to dst, replacing dst atomically.
+func copyFile(src, dst string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return fileformat.Replace(dst, func(w io.Writer) error {
+		_, err := io.Copy(w, f)
+		return err
+	})
+}
+
+// linkFile hard-links src, which is never modified, to dst, falling back
+// to a copy where links are not possible.
+func linkFile(src, dst string) error {
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+	return copyFile(src, dst)
+}
+
+// Checkpoint writes a copy of the store to dir, which must not exist. The
+// copy opens as a store of its own and is what Restore starts from. Each
+// shard is copied as it stood at one moment, but shards are copied one
+// after another while single-shard writes carry on, so the copy is not a
+// snapshot of the store at any one moment; Restore to a point is. Cross-shard
+// batches wait while Checkpoint runs so that none is split. Tables are
+// hard-linked where possible. A failed checkpoint leaves dir partly written.
+func (skv *ShardedKV) Checkpoint(dir string) error {
+	if _, err := os.Stat(dir); err == nil {
+		return fmt.Errorf("checkpoint: %s already exists", dir)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	skv.ckptMu.Lock()
+	defer skv.ckptMu.Unlock()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	if err := copyFile(txnLogFileName(skv.baseDirectory), txnLogFileName(dir)); err != nil {
+		return err
+	}
+	for _, s := range skv.shards {
+		if err := s.checkpoint(filepath.Join(dir, filepath.Base(s.baseDirectory))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkpoint copies the shard to dir: its tables, a manifest of its current
+// version and the segments holding writes not yet in the tables. The last
+// segment is copied as far as it has been written.
+func (db *MiniKV) checkpoint(dir string) error {
+	// A flush could otherwise delete segments before they are copied.
+	db.flushMu.Lock()
+	defer db.flushMu.Unlock()
+	if err := CreateDirs(dir); err != nil {
+		return err
+	}
+
+	db.mu.RLock()
+	v := db.manifest.current()
+	sstables := slices.Clone(db.sstables)
+	for _, t := range sstables {
+		t.Ref()
+	}
+	db.mu.RUnlock()
+	defer unrefTables(sstables)
+
+	for _, t := range sstables {
+		if err := linkFile(t.Path, tableFileName(dir, tableNum(t))); err != nil {
+			return err
+		}
+	}
+	nums, err := liveWALs(db.baseDirectory, v.logNum)
+	if err != nil {
+		return err
+	}
+	for _, num := range nums {
+		if err := copyFile(walFileName(db.baseDirectory, num), walFileName(dir, num)); err != nil {
+			return err
+		}
+	}
+	num := v.nextFile
+	v.nextFile++
+	f, err := createManifest(dir, num, v)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
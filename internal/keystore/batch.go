@@ -0,0 +1,279 @@
+package keystore
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+
+	"github.com/Aswin-Sk/MinionDB/internal/SSTables"
+)
+
+// Batch collects writes to apply together with ShardedKV.Write. The zero
+// value is an empty batch.
+type Batch struct {
+	ops []batchEntry
+}
+
+type batchEntry struct {
+	batchOp
+	// end bounds a range delete, whose start is key.
+	end     string
+	isRange bool
+}
+
+// Put records a write of val to key. val is copied.
+func (b *Batch) Put(key string, val []byte) {
+	b.ops = append(b.ops, batchEntry{batchOp: batchOp{t: opSet, key: key, val: append([]byte(nil), val...)}})
+}
+
+// Delete records the removal of key.
+func (b *Batch) Delete(key string) {
+	b.ops = append(b.ops, batchEntry{batchOp: batchOp{t: opDel, key: key}})
+}
+
+// DeleteRange records the removal of every key in [start, end). An empty
+// end leaves the range unbounded above.
+func (b *Batch) DeleteRange(start, end string) {
+	b.ops = append(b.ops, batchEntry{batchOp: batchOp{t: opDel, key: start}, end: end, isRange: true})
+}
+
+// Len returns the number of writes recorded.
+func (b *Batch) Len() int {
+	return len(b.ops)
+}
+
+// Reset empties the batch for reuse.
+func (b *Batch) Reset() {
+	b.ops = b.ops[:0]
+}
+
+// Write applies b atomically: neither readers nor replay after a crash see
+// part of it. Writes that land on one shard are logged as a single WAL
+// record; a batch spanning shards goes through commit. A range delete
+// removes the keys in the range when Write is called. Every shard is locked
+// against other writes, as by commit, and the writes already queued are
+// applied before the keys are listed; the locks are held until the deletes
+// are applied too.
+func (skv *ShardedKV) Write(b *Batch, wo WriteOptions) error {
+	if err := skv.health.check(); err != nil {
+		return err
+	}
+	if !slices.ContainsFunc(b.ops, func(e batchEntry) bool { return e.isRange }) {
+		parts, ops, err := skv.split(b)
+		if err != nil {
+			return err
+		}
+		switch len(parts) {
+		case 0:
+			return nil
+		case 1:
+			return parts[0].apply(context.Background(), ops[0], wo, true)
+		}
+		return skv.commit(parts, ops, wo)
+	}
+
+	unlock, err := skv.lockShards(skv.shards)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := each(skv.shards, func(_ int, s *MiniKV) error { return s.logged(s.wb.drain()) }); err != nil {
+		return err
+	}
+	parts, ops, err := skv.split(b)
+	if err != nil {
+		return err
+	}
+	switch len(parts) {
+	case 0:
+		return nil
+	case 1:
+		return parts[0].queue(ops[0], wo, true).Wait()
+	}
+	return skv.commitLocked(parts, ops, wo)
+}
+
+// split sorts the writes in b by shard, expanding range deletes to the keys
+// in their ranges, and returns the shards written to, in shard order, with
+// their writes.
+func (skv *ShardedKV) split(b *Batch) ([]*MiniKV, [][]batchOp, error) {
+	perShard := make([][]batchOp, skv.n)
+	for _, e := range b.ops {
+		if !e.isRange {
+			i := skv.shardIndex(e.key)
+			perShard[i] = append(perShard[i], e.batchOp)
+			continue
+		}
+		if e.end != "" && e.key >= e.end {
+			continue
+		}
+		for i, shard := range skv.shards {
+			keys, err := shard.keysInRange(e.key, e.end)
+			if err != nil {
+				return nil, nil, err
+			}
+			// Keys put earlier in this batch are not in the shard yet.
+			for _, op := range perShard[i] {
+				if op.t == opSet && inRange(op.key, e.key, e.end) {
+					keys = append(keys, op.key)
+				}
+			}
+			for _, k := range keys {
+				perShard[i] = append(perShard[i], batchOp{t: opDel, key: k})
+			}
+		}
+	}
+	var parts []*MiniKV
+	var partOps [][]batchOp
+	for i, ops := range perShard {
+		if len(ops) > 0 {
+			parts = append(parts, skv.shards[i])
+			partOps = append(partOps, ops)
+		}
+	}
+	return parts, partOps, nil
+}
+
+// inRange reports whether key is in [start, end), where an empty end is
+// unbounded.
+func inRange(key, start, end string) bool {
+	return key >= start && (end == "" || key < end)
+}
+
+// lockShards locks parts, which are in shard order, against every other
+// write and against Checkpoint, flushing them first where needed, and
+// returns the function that unlocks them. Locking in shard order keeps
+// concurrent batches from deadlocking. walMu keeps a prepared record and
+// its commit record in the same WAL.
+func (skv *ShardedKV) lockShards(parts []*MiniKV) (func(), error) {
+	for _, s := range parts {
+		if err := s.CheckIfFlushNeeded(); err != nil {
+			return nil, err
+		}
+	}
+	skv.ckptMu.RLock()
+	for _, s := range parts {
+		s.txnMu.Lock()
+		s.walMu.RLock()
+	}
+	return func() {
+		for _, s := range slices.Backward(parts) {
+			s.walMu.RUnlock()
+			s.txnMu.Unlock()
+		}
+		skv.ckptMu.RUnlock()
+	}, nil
+}
+
+// commit applies ops[i] to parts[i], which are in shard order, with two-phase
+// commit. Each shard logs and syncs its ops as a prepared record; the batch
+// commits once its id is synced to the transaction log, and only then do the
+// ops reach the memtables. Other writes to these shards wait meanwhile.
+func (skv *ShardedKV) commit(parts []*MiniKV, ops [][]batchOp, wo WriteOptions) error {
+	unlock, err := skv.lockShards(parts)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return skv.commitLocked(parts, ops, wo)
+}
+
+// commitLocked is commit for a caller that holds lockShards on parts.
+func (skv *ShardedKV) commitLocked(parts []*MiniKV, ops [][]batchOp, wo WriteOptions) error {
+	id := skv.txns.nextID()
+	key := txnKey(id)
+	err := each(parts, func(i int, s *MiniKV) error {
+		prepared := append([]batchOp{{t: opPrepare, key: key}}, ops[i]...)
+		return s.logged(s.wb.enqueue(prepared, WriteOptions{Sync: true}))
+	})
+	if err != nil {
+		// Without a commit record the prepared records are dropped on open.
+		return err
+	}
+	if err := skv.txns.commit(id); err != nil {
+		// The record may have reached the disk regardless; the next open
+		// decides the batch's fate from whatever it finds.
+		return skv.health.fail(err)
+	}
+
+	for _, s := range parts {
+		s.mu.Lock()
+	}
+	for i, s := range parts {
+		applyOps(s.index, ops[i])
+	}
+	for _, s := range parts {
+		s.mu.Unlock()
+	}
+	// The commit records give the batch its place among each shard's other
+	// writes when the WAL is replayed.
+	return each(parts, func(i int, s *MiniKV) error {
+		return s.logged(s.wb.enqueue([]batchOp{{t: opCommit, key: key}}, wo))
+	})
+}
+
+// each calls fn for every shard in parts concurrently and returns their
+// errors joined.
+func each(parts []*MiniKV, fn func(i int, s *MiniKV) error) error {
+	errs := make([]error, len(parts))
+	var wg sync.WaitGroup
+	for i, s := range parts {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = fn(i, s)
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// keysInRange returns the keys in [start, end) that are not deleted, where
+// an empty end is unbounded. The memtables are consulted before the tables,
+// newest first, so a key's newest entry decides.
+func (db *MiniKV) keysInRange(start, end string) ([]string, error) {
+	seen := make(map[string]bool)
+	var keys []string
+	add := func(k string, kind SSTables.Kind) {
+		if !inRange(k, start, end) || seen[k] {
+			return
+		}
+		seen[k] = true
+		if kind == SSTables.KindPut {
+			keys = append(keys, k)
+		}
+	}
+
+	db.mu.RLock()
+	for k, e := range db.index {
+		add(k, e.Kind)
+	}
+	for k, e := range db.imm {
+		add(k, e.Kind)
+	}
+	sstables := slices.Clone(db.sstables)
+	for _, t := range sstables {
+		t.Ref()
+	}
+	db.mu.RUnlock()
+	defer unrefTables(sstables)
+
+	// A range scan should not push hot blocks out of the cache.
+	ro := SSTables.ReadOptions{FillCache: false}
+	for i := len(sstables) - 1; i >= 0; i-- {
+		it, err := sstables[i].NewRangeIterator(start, end, ro)
+		if err != nil {
+			return nil, err
+		}
+		for it.Next() {
+			add(it.Key(), it.Kind())
+		}
+		err = it.Err()
+		it.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
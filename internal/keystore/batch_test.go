@@ -0,0 +1,212 @@
+package keystore
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDeleteRangeUnboundedEnd(t *testing.T) {
+	skv, err := NewShardedKV(t.TempDir(), 4, DefaultOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer skv.Close()
+	for _, key := range []string{"a", "m", "x", "zz"} {
+		if err := skv.Set(key, []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var b Batch
+	b.DeleteRange("m", "")
+	if err := skv.Write(&b, WriteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]bool{"a": true, "m": false, "x": false, "zz": false} {
+		if _, ok, err := skv.Get(key); err != nil || ok != want {
+			t.Errorf("%s present = %v, %v; want %v", key, ok, err, want)
+		}
+	}
+}
+
+// A range delete removes every key in its range that was written before it
+// returned, even by writes still queued when it started.
+func TestDeleteRangeConcurrentWrites(t *testing.T) {
+	// Writes sit in the queue until the interval ends.
+	opts := DefaultOptions()
+	opts.WALBatchSize = 1 << 20
+	opts.WALBatchInterval = 50 * time.Millisecond
+	skv, err := NewShardedKV(t.TempDir(), 4, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer skv.Close()
+	const writers, perWriter = 4, 50
+	futures := make([][]*WriteFuture, writers)
+	var wg sync.WaitGroup
+	for w := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range perWriter {
+				futures[w] = append(futures[w], skv.SetAsync(fmt.Sprintf("k-%d-%03d", w, i), []byte("v")))
+			}
+		}()
+	}
+	wg.Wait()
+	var b Batch
+	b.DeleteRange("k-", "k.")
+	if err := skv.Write(&b, WriteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, fs := range futures {
+		for _, f := range fs {
+			if err := f.Wait(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for w := range writers {
+		for i := range perWriter {
+			key := fmt.Sprintf("k-%d-%03d", w, i)
+			if _, ok, err := skv.Get(key); err != nil || ok {
+				t.Fatalf("%s survived the range delete: %v", key, err)
+			}
+		}
+	}
+}
+
+// crash stops skv as a crash would once everything it wrote had reached
+// the disk: nothing is flushed and no outcome is logged.
+func crash(t *testing.T, skv *ShardedKV) {
+	t.Helper()
+	for _, s := range skv.shards {
+		if err := errors.Join(s.wb.Close(), s.manifest.close()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := errors.Join(skv.txns.close(), skv.tables.Close()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// keysOnShards returns a key for each of the first n shards of skv.
+func keysOnShards(skv *ShardedKV, n int) []string {
+	keys := make([]string, n)
+	for i := 0; slices.Contains(keys, ""); i++ {
+		k := fmt.Sprintf("key-%d", i)
+		if s := skv.shardIndex(k); s < n && keys[s] == "" {
+			keys[s] = k
+		}
+	}
+	return keys
+}
+
+// A cross-shard batch is decided by the transaction log: one whose commit
+// record reached it survives a crash before any shard logged its commit
+// record, and one whose commit record did not is dropped.
+func TestCommitCrashBeforeShardCommitRecords(t *testing.T) {
+	for _, committed := range []bool{true, false} {
+		t.Run(fmt.Sprintf("committed=%v", committed), func(t *testing.T) {
+			dir := t.TempDir()
+			skv, err := NewShardedKV(dir, 2, DefaultOptions())
+			if err != nil {
+				t.Fatal(err)
+			}
+			keys := keysOnShards(skv, 2)
+
+			// commitLocked up to its commit records.
+			unlock, err := skv.lockShards(skv.shards)
+			if err != nil {
+				t.Fatal(err)
+			}
+			id := skv.txns.nextID()
+			for i, s := range skv.shards {
+				prepared := []batchOp{{t: opPrepare, key: txnKey(id)}, {t: opSet, key: keys[i], val: []byte("v")}}
+				if err := s.wb.enqueue(prepared, WriteOptions{Sync: true}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if committed {
+				if err := skv.txns.commit(id); err != nil {
+					t.Fatal(err)
+				}
+			}
+			unlock()
+			crash(t, skv)
+
+			// The second open finds the outcomes logged by the first in the
+			// shards, and an empty transaction log.
+			for range 2 {
+				skv, err = NewShardedKV(dir, 2, DefaultOptions())
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, key := range keys {
+					if _, ok, err := skv.Get(key); err != nil || ok != committed {
+						t.Fatalf("%s present = %v, %v; want %v", key, ok, err, committed)
+					}
+				}
+				crash(t, skv)
+			}
+		})
+	}
+}
+
+// A batch on one shard is a single WAL record, so a crash that tears it
+// loses all of it and one that does not keeps all of it.
+func TestBatchOnOneShardIsOneRecord(t *testing.T) {
+	for _, torn := range []bool{false, true} {
+		t.Run(fmt.Sprintf("torn=%v", torn), func(t *testing.T) {
+			dir := t.TempDir()
+			skv, err := NewShardedKV(dir, 1, DefaultOptions())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := skv.Set("x", []byte("old")); err != nil {
+				t.Fatal(err)
+			}
+			var b Batch
+			val := []byte("v")
+			b.Put("a", val)
+			b.Put("b", val)
+			b.Delete("x")
+			// The batch holds its own copy.
+			val[0] = 'w'
+			if err := skv.Write(&b, WriteOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			segment := skv.shards[0].wb.file.Name()
+			crash(t, skv)
+			if torn {
+				st, err := os.Stat(segment)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := os.Truncate(segment, st.Size()-3); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			skv, err = NewShardedKV(dir, 1, DefaultOptions())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer skv.Close()
+			want := map[string]string{"a": "v", "b": "v", "x": ""}
+			if torn {
+				want = map[string]string{"a": "", "b": "", "x": "old"}
+			}
+			for key, w := range want {
+				val, ok, err := skv.Get(key)
+				if err != nil || ok != (w != "") || string(val) != w {
+					t.Fatalf("%s = %q, %v, %v; want %q", key, val, ok, err, w)
+				}
+			}
+		})
+	}
+}
@@ -1,48 +1,194 @@
 package keystore
 
 import (
-	"encoding/binary"
+	"errors"
+	"fmt"
 	"os"
+	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// ErrBusy is returned by the context-aware writes, rather than waiting,
+// when a shard's WAL queue is full.
+var ErrBusy = errors.New("write queue is full")
+
+// walQueueSize is the most batches queued on a batcher.
+const walQueueSize = 4096
+
 type opType byte
 
 const (
 	opSet opType = iota
 	opDel
+	// A prepare op opens a WAL record holding one shard's part of a
+	// cross-shard batch; the commit or abort record that resolves it comes
+	// later. Their keys hold the transaction id.
+	opPrepare
+	opCommit
+	opAbort
+)
+
+// Durability decides when the WAL is synced to stable storage.
+type Durability int
+
+const (
+	// SyncEveryBatch syncs after every batch, before any write in it is
+	// acknowledged.
+	SyncEveryBatch Durability = iota
+	// SyncInterval syncs at most once per sync interval. Writes are
+	// acknowledged once written, so a crash can lose up to one interval
+	// of acknowledged writes.
+	SyncInterval
+	// NoSync leaves syncing to the operating system. A crash of the
+	// machine, but not of the process, can lose acknowledged writes.
+	NoSync
 )
 
+func (d Durability) String() string {
+	switch d {
+	case SyncEveryBatch:
+		return "sync-every-batch"
+	case SyncInterval:
+		return "sync-interval"
+	case NoSync:
+		return "no-sync"
+	default:
+		return fmt.Sprintf("Durability(%d)", int(d))
+	}
+}
+
+// WriteOptions overrides the store's durability for a single write.
+type WriteOptions struct {
+	// Sync acknowledges the write only once the WAL has been synced,
+	// whatever the durability mode.
+	Sync bool
+	// NoSync acknowledges the write without waiting for a sync, whatever
+	// the durability mode. Sync wins if both are set.
+	NoSync bool
+}
+
+// writeReq is one batch of ops, logged as a single WAL record.
 type writeReq struct {
-	t    opType
-	key  string
-	val  []byte
-	done chan error
+	ops  []batchOp
+	wo   WriteOptions
+	done *WriteFuture
+}
+
+// WriteFuture is a write that has been queued for the WAL. It completes
+// once the write is logged, or synced if the durability calls for it, and
+// applied to the memtable.
+type WriteFuture struct {
+	done chan struct{}
+	// err is set before done is closed.
+	err error
+}
+
+func newWriteFuture() *WriteFuture {
+	return &WriteFuture{done: make(chan struct{})}
+}
+
+// FailedWrite returns a completed future for a write that was never queued.
+func FailedWrite(err error) *WriteFuture {
+	f := newWriteFuture()
+	f.err = err
+	close(f.done)
+	return f
+}
+
+func (f *WriteFuture) complete(err error) {
+	f.err = err
+	close(f.done)
+}
+
+// Done is closed once the write has completed.
+func (f *WriteFuture) Done() <-chan struct{} {
+	return f.done
+}
+
+// Wait waits for the write to complete and returns its error.
+func (f *WriteFuture) Wait() error {
+	<-f.done
+	return f.err
 }
 
 type WriteBatcher struct {
-	mu       sync.Mutex
-	reqCh    chan writeReq
-	file     *os.File
-	batchSz  int
-	interval time.Duration
+	mu sync.Mutex
+	// err is the first write or sync failure. Every later batch fails with
+	// it without touching the file, which may end in a partial record.
+	err   error
+	reqCh chan writeReq
+	// slots holds a token for every batch queued or about to be, so a
+	// write can claim its place before touching the memtable.
+	slots chan struct{}
+	// file is the segment being written. Once it reaches segmentSize
+	// writes move on to a new one.
+	file        *os.File
+	size        int64
+	segmentSize int64
+	log         *shardLog
+	// lastSeq is the number of the last record written here, or what the
+	// sequence stood at when the batcher started: nothing the batcher's
+	// memtable holds is numbered higher.
+	lastSeq uint64
+	// prepared holds the parts of cross-shard batches awaiting their
+	// commit record, whose events are only published with it.
+	prepared     map[uint64][]batchOp
+	batchSz      int
+	interval     time.Duration
+	durability   Durability
+	syncInterval time.Duration
+	// dirty is set while the file holds writes that have not been synced.
+	dirty    bool
+	lastSync time.Time
 	stopCh   chan struct{}
 	wg       sync.WaitGroup
 }
 
-func NewWriteBatcher(path string, batchSz int, interval time.Duration) (*WriteBatcher, error) {
-	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+// shardLog is what a shard's successive batchers share: the sequence that
+// numbers the records of every shard, the source of new segment paths, what
+// to do with a full segment, the memtable logged records are applied to and
+// the hub their records are published to, and how failures are reported.
+type shardLog struct {
+	shard      int
+	seq        *atomic.Uint64
+	newSegment func() (string, error)
+	sealed     func()
+	// apply, if set, applies records to the memtable once they are logged,
+	// in the order they were logged.
+	apply func(recs [][]batchOp)
+	// fail, if set, marks the store degraded as soon as a write or sync
+	// fails, whether or not anyone waits for the writes it fails.
+	fail   func(error) error
+	events *eventHub
+}
+
+// NewWriteBatcher starts a batcher writing to a new segment at path.
+func NewWriteBatcher(path string, opts Options, log *shardLog) (*WriteBatcher, error) {
+	f, size, err := openSegment(path)
 	if err != nil {
 		return nil, err
 	}
 
 	wb := &WriteBatcher{
-		reqCh:    make(chan writeReq, 4096),
-		file:     f,
-		batchSz:  batchSz,
-		interval: interval,
-		stopCh:   make(chan struct{}),
+		reqCh:        make(chan writeReq, walQueueSize),
+		slots:        make(chan struct{}, walQueueSize),
+		file:         f,
+		size:         size,
+		segmentSize:  opts.WALSegmentSize,
+		log:          log,
+		lastSeq:      log.seq.Load(),
+		prepared:     make(map[uint64][]batchOp),
+		batchSz:      max(opts.WALBatchSize, 1),
+		interval:     opts.WALBatchInterval,
+		durability:   opts.Durability,
+		syncInterval: opts.SyncInterval,
+		lastSync:     time.Now(),
+		stopCh:       make(chan struct{}),
+	}
+	if wb.interval <= 0 {
+		wb.interval = time.Millisecond
 	}
 
 	wb.wg.Add(1)
@@ -60,6 +206,7 @@ func (wb *WriteBatcher) loop() {
 	for {
 		select {
 		case req := <-wb.reqCh:
+			<-wb.slots
 			batch = append(batch, req)
 			if len(batch) >= wb.batchSz {
 				wb.flush(batch)
@@ -70,75 +217,221 @@ func (wb *WriteBatcher) loop() {
 				wb.flush(batch)
 				batch = nil
 			}
+			wb.syncIfDue()
 		case <-wb.stopCh:
+			// Nothing is queued once the batcher is stopped, but writes
+			// whose writers did not wait for them may still be queued.
+			for len(wb.reqCh) > 0 {
+				batch = append(batch, <-wb.reqCh)
+				<-wb.slots
+			}
 			if len(batch) > 0 {
 				wb.flush(batch)
 			}
+			wb.mu.Lock()
+			wb.syncLocked()
+			wb.mu.Unlock()
 			return
 		}
 	}
 }
 
-func (wb *WriteBatcher) flush(batch []writeReq) {
+func (wb *WriteBatcher) flush(all []writeReq) {
 	wb.mu.Lock()
 	defer wb.mu.Unlock()
 
-	for _, r := range batch {
-		// write op
-		wb.file.Write([]byte{byte(r.t)})
-
-		// write key length
-		var klenBuf [4]byte
-		binary.LittleEndian.PutUint32(klenBuf[:], uint32(len(r.key)))
-		wb.file.Write(klenBuf[:])
-
-		// write value length (for Set only)
-		if r.t == opSet {
-			var vlenBuf [4]byte
-			binary.LittleEndian.PutUint32(vlenBuf[:], uint32(len(r.val)))
-			wb.file.Write(vlenBuf[:])
+	// Requests from drain hold no ops and are only acknowledged.
+	var batch []writeReq
+	for _, r := range all {
+		if r.ops != nil {
+			batch = append(batch, r)
+		}
+	}
+	if wb.err == nil && len(batch) > 0 {
+		var buf []byte
+		recs := make([]published, len(batch))
+		now := time.Now().UnixNano()
+		for i, r := range batch {
+			wb.lastSeq = wb.log.seq.Add(1)
+			recs[i].seq = wb.lastSeq
+			buf = appendWALRecord(buf, wb.lastSeq, now, r.ops)
 		}
+		if _, err := wb.file.Write(buf); err != nil {
+			wb.fail(err)
+		} else {
+			wb.size += int64(len(buf))
+			wb.dirty = true
+			if wb.mustSync(batch) {
+				wb.syncLocked()
+			}
+		}
+		// Numbers taken by records that failed are published too, without
+		// events, so that the hub does not wait for them.
+		if wb.err == nil {
+			if wb.log.apply != nil {
+				ops := make([][]batchOp, len(batch))
+				for i, r := range batch {
+					ops[i] = r.ops
+				}
+				wb.log.apply(ops)
+			}
+			for i, r := range batch {
+				recs[i].events = toEvents(recs[i].seq, wb.log.shard, resolve(wb.prepared, r.ops))
+			}
+		}
+		wb.log.events.publish(recs)
+	}
 
-		// write key
-		wb.file.Write([]byte(r.key))
+	// Acknowledge all requests
+	for _, r := range all {
+		r.done.complete(wb.err)
+	}
 
-		if r.t == opSet {
-			wb.file.Write(r.val)
-		}
+	if wb.err == nil && wb.segmentSize > 0 && wb.size >= wb.segmentSize {
+		wb.rotateLocked()
 	}
+}
 
-	wb.file.Sync()
+// rotateLocked moves writing on to a new segment. The full one is synced
+// first, whatever the durability, as it will not be synced later.
+func (wb *WriteBatcher) rotateLocked() {
+	wb.syncLocked()
+	if wb.err != nil {
+		return
+	}
+	path, err := wb.log.newSegment()
+	if err != nil {
+		wb.fail(err)
+		return
+	}
+	f, size, err := openSegment(path)
+	if err != nil {
+		wb.fail(err)
+		return
+	}
+	wb.file.Close()
+	wb.file, wb.size = f, size
+	if wb.log.sealed != nil {
+		wb.log.sealed()
+	}
+}
 
-	// Acknowledge all requests
+func openSegment(path string) (*os.File, int64, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, 0, err
+	}
+	size, err := initWAL(f)
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, size, nil
+}
+
+// mustSync reports whether batch has to be synced before it is
+// acknowledged.
+func (wb *WriteBatcher) mustSync(batch []writeReq) bool {
 	for _, r := range batch {
-		r.done <- nil
-		close(r.done)
+		switch {
+		case r.wo.Sync:
+			return true
+		case r.wo.NoSync:
+		case wb.durability == SyncEveryBatch:
+			return true
+		case wb.durability == SyncInterval && time.Since(wb.lastSync) >= wb.syncInterval:
+			return true
+		}
 	}
+	return false
 }
 
-func (wb *WriteBatcher) EnqueueSet(key string, val []byte) error {
-	req := writeReq{
-		t:    opSet,
-		key:  key,
-		val:  append([]byte(nil), val...),
-		done: make(chan error, 1),
+// syncIfDue syncs writes left unsynced for a full sync interval.
+func (wb *WriteBatcher) syncIfDue() {
+	wb.mu.Lock()
+	defer wb.mu.Unlock()
+	if wb.durability == SyncInterval && time.Since(wb.lastSync) >= wb.syncInterval {
+		wb.syncLocked()
 	}
-	wb.reqCh <- req
-	return <-req.done
 }
 
-func (wb *WriteBatcher) EnqueueDel(key string) error {
-	req := writeReq{
-		t:    opDel,
-		key:  key,
-		done: make(chan error, 1),
+func (wb *WriteBatcher) syncLocked() {
+	if !wb.dirty || wb.err != nil {
+		return
 	}
+	if err := wb.file.Sync(); err != nil {
+		wb.fail(err)
+		return
+	}
+	wb.dirty = false
+	wb.lastSync = time.Now()
+}
+
+// fail records err as the batcher's failure, which every later batch fails
+// with, and reports it to the store.
+func (wb *WriteBatcher) fail(err error) {
+	wb.err = &DegradedError{Cause: err}
+	if wb.log.fail != nil {
+		wb.log.fail(wb.err)
+	}
+}
+
+// enqueue logs ops as one record and waits for it to be acknowledged. The
+// ops are not copied.
+func (wb *WriteBatcher) enqueue(ops []batchOp, wo WriteOptions) error {
+	wb.reserve(true)
+	return wb.submit(ops, wo).Wait()
+}
+
+// drain waits until every batch queued before it has been logged and
+// applied to the memtable.
+func (wb *WriteBatcher) drain() error {
+	wb.reserve(true)
+	return wb.submit(nil, WriteOptions{}).Wait()
+}
+
+// reserve claims a place in the queue for one batch. If block is false it
+// fails with ErrBusy instead of waiting for the queue to drain.
+func (wb *WriteBatcher) reserve(block bool) error {
+	if block {
+		wb.slots <- struct{}{}
+		return nil
+	}
+	select {
+	case wb.slots <- struct{}{}:
+		return nil
+	default:
+		return ErrBusy
+	}
+}
+
+// submit queues ops as one record in the place claimed by reserve. The ops
+// are not copied.
+func (wb *WriteBatcher) submit(ops []batchOp, wo WriteOptions) *WriteFuture {
+	req := writeReq{ops: ops, wo: wo, done: newWriteFuture()}
 	wb.reqCh <- req
-	return <-req.done
+	return req.done
+}
+
+// segment returns the number of the segment being written.
+func (wb *WriteBatcher) segment() uint64 {
+	wb.mu.Lock()
+	defer wb.mu.Unlock()
+	_, num, _ := parseFileName(filepath.Base(wb.file.Name()))
+	return num
+}
+
+// LastSeq returns the sequence number of the last record written.
+func (wb *WriteBatcher) LastSeq() uint64 {
+	wb.mu.Lock()
+	defer wb.mu.Unlock()
+	return wb.lastSeq
 }
 
+// Close writes and syncs any pending batch and closes the file. It reports
+// a failure to sync writes that were acknowledged without one.
 func (wb *WriteBatcher) Close() error {
 	close(wb.stopCh)
 	wb.wg.Wait()
-	return wb.file.Close()
+	return errors.Join(wb.file.Close(), wb.err)
 }
@@ -0,0 +1,84 @@
+package keystore
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// A write is acknowledged synced or not according to the store's
+// durability, unless its options override it.
+func TestDurability(t *testing.T) {
+	tests := []struct {
+		durability Durability
+		wo         WriteOptions
+		synced     bool
+	}{
+		{SyncEveryBatch, WriteOptions{}, true},
+		{SyncEveryBatch, WriteOptions{NoSync: true}, false},
+		{SyncInterval, WriteOptions{}, false},
+		{SyncInterval, WriteOptions{Sync: true}, true},
+		{NoSync, WriteOptions{}, false},
+		{NoSync, WriteOptions{Sync: true}, true},
+		{NoSync, WriteOptions{Sync: true, NoSync: true}, true},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%v/%+v", tt.durability, tt.wo), func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.Durability = tt.durability
+			opts.SyncInterval = time.Hour
+			skv, err := NewShardedKV(t.TempDir(), 1, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer skv.Close()
+			wb := skv.shards[0].wb
+			// The interval starts at open, so no write is due a sync by it.
+			if err := skv.SetWithOptions("k", []byte("v"), tt.wo); err != nil {
+				t.Fatal(err)
+			}
+			wb.mu.Lock()
+			dirty := wb.dirty
+			wb.mu.Unlock()
+			if dirty == tt.synced {
+				t.Fatalf("write acknowledged with synced = %v, want %v", !dirty, tt.synced)
+			}
+		})
+	}
+}
+
+func TestSyncIntervalSyncsInBackground(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Durability = SyncInterval
+	opts.SyncInterval = 10 * time.Millisecond
+	skv, err := NewShardedKV(t.TempDir(), 1, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer skv.Close()
+	wb := skv.shards[0].wb
+	// Far enough from the last sync that the write itself is not synced.
+	wb.mu.Lock()
+	wb.lastSync = time.Now().Add(time.Hour)
+	wb.mu.Unlock()
+	if err := skv.Set("k", []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	wb.mu.Lock()
+	wb.lastSync = time.Now().Add(-time.Hour)
+	wb.mu.Unlock()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		wb.mu.Lock()
+		dirty := wb.dirty
+		wb.mu.Unlock()
+		if !dirty {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("unsynced write left unsynced past its interval")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
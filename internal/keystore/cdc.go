@@ -0,0 +1,361 @@
+package keystore
+
+import (
+	"errors"
+	"maps"
+	"os"
+	"slices"
+	"sync"
+)
+
+var (
+	// ErrTrimmed is returned by Subscribe when WAL segments holding writes
+	// it was asked for have already been deleted.
+	ErrTrimmed = errors.New("requested writes are no longer retained in the WAL")
+	// ErrLagged ends a subscription whose reader fell too far behind. It can
+	// resubscribe from the sequence number after the last event it saw.
+	ErrLagged = errors.New("subscriber fell too far behind")
+)
+
+// maxSubscriptionLag is the most events held for a subscription whose
+// reader is not keeping up.
+const maxSubscriptionLag = 1 << 16
+
+type EventType int
+
+const (
+	EventSet EventType = iota
+	EventDelete
+)
+
+// Event is one write, numbered by the WAL record that logged it. The writes
+// of one batch on one shard share a sequence number; each shard's part of a
+// cross-shard batch takes the number of the commit record it logs.
+type Event struct {
+	Seq   uint64
+	Shard int
+	Type  EventType
+	Key   string
+	Value []byte
+}
+
+func toEvents(seq uint64, shard int, ops []batchOp) []Event {
+	evs := make([]Event, len(ops))
+	for i, op := range ops {
+		evs[i] = Event{Seq: seq, Shard: shard, Key: op.key, Value: op.val}
+		if op.t == opDel {
+			evs[i].Type = EventDelete
+		}
+	}
+	return evs
+}
+
+// published is what a written WAL record adds to the stream: no events for
+// records that failed or only prepare or abort a cross-shard batch.
+type published struct {
+	seq    uint64
+	events []Event
+}
+
+// eventHub puts the records written by every shard's batcher back into
+// sequence order and passes their events to the subscriptions. A record is
+// held until every lower-numbered record has been written.
+type eventHub struct {
+	mu   sync.Mutex
+	next uint64
+	held map[uint64][]Event
+	subs map[*Subscription]struct{}
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{held: make(map[uint64][]Event), subs: make(map[*Subscription]struct{})}
+}
+
+// start sets the sequence number of the first record to be published.
+func (h *eventHub) start(next uint64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.next = next
+}
+
+func (h *eventHub) publish(recs []published) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, r := range recs {
+		h.held[r.seq] = r.events
+	}
+	for {
+		evs, ok := h.held[h.next]
+		if !ok {
+			return
+		}
+		delete(h.held, h.next)
+		h.next++
+		if len(evs) == 0 {
+			continue
+		}
+		for s := range h.subs {
+			s.push(evs)
+		}
+	}
+}
+
+// subscribe adds s and returns the sequence number of the first record it
+// will be passed; every earlier record has been written.
+func (h *eventHub) subscribe(s *Subscription) uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.subs[s] = struct{}{}
+	return h.next
+}
+
+func (h *eventHub) unsubscribe(s *Subscription) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.subs, s)
+}
+
+// close ends every subscription.
+func (h *eventHub) close() {
+	h.mu.Lock()
+	subs := slices.Collect(maps.Keys(h.subs))
+	h.mu.Unlock()
+	for _, s := range subs {
+		s.Close()
+	}
+}
+
+// Subscription is an ordered stream of events. Readers persist the sequence
+// number of the last event they handled and resume from the next one.
+type Subscription struct {
+	ch     chan Event
+	done   chan struct{}
+	notify chan struct{}
+	hub    *eventHub
+	once   sync.Once
+
+	mu    sync.Mutex
+	queue []Event
+	err   error
+}
+
+func newSubscription(hub *eventHub) *Subscription {
+	return &Subscription{
+		ch:     make(chan Event),
+		done:   make(chan struct{}),
+		notify: make(chan struct{}, 1),
+		hub:    hub,
+	}
+}
+
+// Events returns the stream. It is closed when the subscription ends,
+// including when the store is closed; Err then says why.
+func (s *Subscription) Events() <-chan Event {
+	return s.ch
+}
+
+// Err returns the error that ended the subscription, or nil if it is still
+// running or was closed.
+func (s *Subscription) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// Close ends the subscription.
+func (s *Subscription) Close() error {
+	s.once.Do(func() { close(s.done) })
+	s.hub.unsubscribe(s)
+	return nil
+}
+
+func (s *Subscription) push(evs []Event) {
+	s.mu.Lock()
+	if s.err == nil {
+		if len(s.queue)+len(evs) > maxSubscriptionLag {
+			s.err = ErrLagged
+		} else {
+			s.queue = append(s.queue, evs...)
+		}
+	}
+	s.mu.Unlock()
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Subscription) fail(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err == nil {
+		s.err = err
+	}
+}
+
+func (s *Subscription) send(e Event) bool {
+	select {
+	case s.ch <- e:
+		return true
+	case <-s.done:
+		return false
+	}
+}
+
+// run sends the events history replays and then the ones pushed since the
+// subscription was added to the hub.
+func (s *Subscription) run(history func(send func(Event) bool) error) {
+	defer close(s.ch)
+	defer s.hub.unsubscribe(s)
+	if err := history(s.send); err != nil {
+		s.fail(err)
+		return
+	}
+	for {
+		s.mu.Lock()
+		evs, err := s.queue, s.err
+		s.queue = nil
+		s.mu.Unlock()
+		for _, e := range evs {
+			if !s.send(e) {
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+		select {
+		case <-s.notify:
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// Subscribe streams the events of records numbered fromSeq or later, in
+// sequence order. Records already written are read back from the WAL
+// segments each shard retains; if some are gone it fails with ErrTrimmed.
+// A fromSeq of zero starts with the next write.
+func (skv *ShardedKV) Subscribe(fromSeq uint64) (*Subscription, error) {
+	s := newSubscription(skv.events)
+	upTo := skv.events.subscribe(s)
+	if fromSeq == 0 || fromSeq > upTo {
+		fromSeq = upTo
+	}
+	var segments [][]string
+	if fromSeq < upTo {
+		for _, shard := range skv.shards {
+			paths, err := shard.walSegments()
+			if err != nil {
+				s.Close()
+				return nil, err
+			}
+			// Checked after listing, so no segment can be deleted unseen.
+			if fromSeq <= shard.manifest.current().trimmedSeq {
+				s.Close()
+				return nil, ErrTrimmed
+			}
+			segments = append(segments, paths)
+		}
+	}
+	go s.run(func(send func(Event) bool) error {
+		return replayHistory(segments, fromSeq, upTo, send)
+	})
+	return s, nil
+}
+
+// historyCursor walks the records of one shard's segments in order and
+// stops at those that carry writes.
+type historyCursor struct {
+	shard   int
+	paths   []string
+	r       *walReader
+	pending map[uint64][]batchOp
+	seq     uint64
+	ops     []batchOp
+	err     error
+}
+
+func (c *historyCursor) next() bool {
+	for c.err == nil {
+		if c.r == nil {
+			if len(c.paths) == 0 {
+				return false
+			}
+			r, err := openWALReader(c.paths[0])
+			if err != nil {
+				if os.IsNotExist(err) {
+					err = ErrTrimmed
+				}
+				c.err = err
+				return false
+			}
+			c.r, c.paths = r, c.paths[1:]
+		}
+		if !c.r.next() {
+			c.err = c.r.err
+			c.r.close()
+			c.r = nil
+			continue
+		}
+		// Records from before sequence numbers were logged are skipped.
+		if ops := resolve(c.pending, c.r.rec.ops); len(ops) > 0 && c.r.rec.seq != 0 {
+			c.seq, c.ops = c.r.rec.seq, ops
+			return true
+		}
+	}
+	return false
+}
+
+func (c *historyCursor) close() {
+	if c.r != nil {
+		c.r.close()
+	}
+}
+
+// replayHistory sends the events of the records numbered from from up to,
+// but not including, to, merging the shards' segments into sequence order.
+func replayHistory(segments [][]string, from, to uint64, send func(Event) bool) error {
+	var cursors []*historyCursor
+	defer func() {
+		for _, c := range cursors {
+			c.close()
+		}
+	}()
+	for shard, paths := range segments {
+		c := &historyCursor{shard: shard, paths: paths, pending: make(map[uint64][]batchOp)}
+		if c.next() {
+			cursors = append(cursors, c)
+		} else if c.err != nil {
+			return c.err
+		}
+	}
+	for len(cursors) > 0 {
+		lo := 0
+		for i, c := range cursors {
+			if c.seq < cursors[lo].seq {
+				lo = i
+			}
+		}
+		c := cursors[lo]
+		if c.seq >= to {
+			c.close()
+			cursors = slices.Delete(cursors, lo, lo+1)
+			continue
+		}
+		if c.seq >= from {
+			for _, e := range toEvents(c.seq, c.shard, c.ops) {
+				if !send(e) {
+					return nil
+				}
+			}
+		}
+		if !c.next() {
+			if c.err != nil {
+				return c.err
+			}
+			cursors = slices.Delete(cursors, lo, lo+1)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package keystore
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// receive reads n events from s.
+func receive(t *testing.T, s *Subscription, n int) []Event {
+	t.Helper()
+	var evs []Event
+	for len(evs) < n {
+		select {
+		case e, ok := <-s.Events():
+			if !ok {
+				t.Fatalf("stream ended after %d events: %v", len(evs), s.Err())
+			}
+			evs = append(evs, e)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("received %d events, want %d", len(evs), n)
+		}
+	}
+	return evs
+}
+
+func TestSubscribe(t *testing.T) {
+	skv, err := NewShardedKV(t.TempDir(), 4, DefaultOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer skv.Close()
+	for i := range 10 {
+		if err := skv.Set(fmt.Sprintf("k%d", i), []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := skv.Delete("k3"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Written records come from the WAL, later ones as they are written.
+	sub, err := skv.Subscribe(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	// Two keys on one shard.
+	var keys []string
+	for i := 0; len(keys) < 2; i++ {
+		if key := fmt.Sprintf("b%d", i); skv.shardIndex(key) == 0 {
+			keys = append(keys, key)
+		}
+	}
+	var b Batch
+	b.Put(keys[0], []byte("b"))
+	b.Put(keys[1], []byte("b"))
+	if err := skv.Write(&b, WriteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	evs := receive(t, sub, 13)
+	for i, e := range evs[:11] {
+		key, typ := fmt.Sprintf("k%d", i), EventSet
+		if i == 10 {
+			key, typ = "k3", EventDelete
+		}
+		if e.Key != key || e.Type != typ || e.Shard != skv.shardIndex(key) {
+			t.Fatalf("event %d = %+v, want %v of %s on shard %d", i, e, typ, key, skv.shardIndex(key))
+		}
+		if i > 0 && e.Seq <= evs[i-1].Seq {
+			t.Fatalf("event %d has seq %d after %d", i, e.Seq, evs[i-1].Seq)
+		}
+	}
+	// The writes of one batch on one shard share a number.
+	if evs[11].Seq != evs[12].Seq || evs[11].Seq <= evs[10].Seq {
+		t.Fatalf("batch events %+v and %+v", evs[11], evs[12])
+	}
+
+	// A reader resumes after the last event it handled.
+	resumed, err := skv.Subscribe(evs[4].Seq + 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resumed.Close()
+	if e := receive(t, resumed, 1)[0]; e.Seq != evs[5].Seq || e.Key != evs[5].Key {
+		t.Fatalf("resumed at %+v, want %+v", e, evs[5])
+	}
+}
+
+func TestSubscribeTrimmed(t *testing.T) {
+	skv, err := NewShardedKV(t.TempDir(), 1, DefaultOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer skv.Close()
+	if err := skv.Set("k", []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	if err := skv.shards[0].flushMemtable(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := skv.Subscribe(1); !errors.Is(err, ErrTrimmed) {
+		t.Fatalf("Subscribe to deleted segments: got %v, want ErrTrimmed", err)
+	}
+}
@@ -1,108 +1,64 @@
 package keystore
 
 import (
-	"errors"
 	"os"
-	"path/filepath"
 	"time"
 
 	"github.com/Aswin-Sk/MinionDB/internal/SSTables"
 	"github.com/Aswin-Sk/MinionDB/internal/logger"
 )
 
-var ErrWalExists = errors.New("WAL already exists")
-
-func (db *MiniKV) Compact(basePath string) error {
-
-	newPath, err := nextWALPath(basePath)
-	if err != nil {
-		return err
-	}
-	newBatcher, err := NewWriteBatcher(newPath, db.wb.batchSz, db.wb.interval)
-	if err != nil && !errors.Is(err, os.ErrExist) {
-		return err
-	}
-	oldBatcher := db.swapWriteBatcher(newBatcher)
-
-	go func(old *WriteBatcher) {
-		// Snapshot current memtable
-		db.mu.RLock()
-		snapshot := make(map[string][]byte, len(db.index))
-		for k, v := range db.index {
-			snapshot[k] = append([]byte(nil), v...)
-		}
-		db.mu.RUnlock()
-
-		// Flush memtable snapshot to a new SSTable
-		sstPath := db.nextSSTablePath()
-		if err := SSTables.WriteSSTable(sstPath, snapshot); err != nil {
-			logger.Logger.Error("Error writing SSTable:", "error", err)
-			return
-		}
-
-		// Update db.sstables and clear memtable
-		db.mu.Lock()
-		db.sstables = append(db.sstables, SSTables.SSTable{Path: sstPath})
-		db.index = make(map[string][]byte)
-		db.mu.Unlock()
-
-		old.Close()
-		os.Remove(old.file.Name())
-
-	}(oldBatcher)
-
-	return nil
+// Compact moves the memtable into a new SSTable and retires its WAL.
+func (db *MiniKV) Compact() error {
+	return db.flushMemtable()
 }
 
+// CompactSSTables merges every table present when it starts into one. The
+// merge is streamed, so memory use does not grow with table size. Tables
+// flushed while the merge runs are newer than its output and stay in place.
 func (db *MiniKV) CompactSSTables() error {
 	db.mu.Lock()
 	if len(db.sstables) < 2 {
 		db.mu.Unlock()
 		return nil
 	}
-
-	sst1 := db.sstables[0]
-	sst2 := db.sstables[1]
+	inputs := append([]*SSTables.SSTable(nil), db.sstables...)
 	db.mu.Unlock()
 
-	mergedPath := db.nextSSTablePath()
-	if err := SSTables.MergeSSTables(mergedPath, sst1.Path, sst2.Path); err != nil {
+	paths := make([]string, len(inputs))
+	nums := make([]uint64, len(inputs))
+	for i, t := range inputs {
+		paths[i] = t.Path
+		nums[i] = tableNum(t)
+	}
+	mergedNum, mergedPath, err := db.newTablePath()
+	if err != nil {
 		return err
 	}
-
-	db.mu.Lock()
-	db.sstables = append(db.sstables[2:], SSTables.SSTable{Path: mergedPath})
-	db.mu.Unlock()
-
-	os.Remove(sst1.Path)
-	os.Remove(sst2.Path)
-
-	return nil
-}
-
-func nextWALPath(basePath string) (string, error) {
-	walDir := filepath.Join(basePath, "wal")
-	if err := os.MkdirAll(walDir, 0755); err != nil {
-		return "", err
+	if err := SSTables.MergeSSTables(mergedPath, paths, db.opts.Table); err != nil {
+		return err
 	}
-
-	newPath := filepath.Join(walDir, "new.wal")
-	return newPath, nil
-}
-
-func getWALPath(basePath string) (string, error) {
-	walDir := filepath.Join(basePath, "wal")
-	if err := os.MkdirAll(walDir, 0755); err != nil {
-		return "", err
+	merged, err := db.tables.Open(mergedPath)
+	if err != nil {
+		return err
 	}
 
-	newPath := filepath.Join(walDir, "active.wal")
-	_, err := os.Stat(filepath.Join(walDir, "active.wal"))
-	if err == nil {
-		return newPath, ErrWalExists
+	db.mu.Lock()
+	edit := versionEdit{deleted: nums, added: []uint64{mergedNum}}
+	if err := db.manifest.logAndApply(edit); err != nil {
+		db.mu.Unlock()
+		os.Remove(mergedPath)
+		return err
 	}
+	db.sstables = append([]*SSTables.SSTable{merged}, db.sstables[len(inputs):]...)
+	db.mu.Unlock()
 
-	return newPath, nil
+	// The inputs' files go once the last lookup still reading them is done.
+	for _, t := range inputs {
+		t.MarkObsolete()
+	}
+	unrefTables(inputs)
+	return nil
 }
 
 func (skv *ShardedKV) BackgroundCompaction(path string, stopCh chan struct{}) {
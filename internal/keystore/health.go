@@ -0,0 +1,53 @@
+package keystore
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+)
+
+// ErrDegraded matches every DegradedError via errors.Is.
+var ErrDegraded = errors.New("store is degraded")
+
+// DegradedError is returned by every write once a WAL write or sync has
+// failed. The store stays read-only until it is reopened, since the WAL may
+// hold a partial batch and the state of unsynced data is unknown.
+type DegradedError struct {
+	Cause error
+}
+
+func (e *DegradedError) Error() string {
+	return fmt.Sprintf("store is read-only after a WAL failure: %v", e.Cause)
+}
+
+func (e *DegradedError) Is(target error) bool {
+	return target == ErrDegraded
+}
+
+func (e *DegradedError) Unwrap() error {
+	return e.Cause
+}
+
+// health holds the first WAL failure of a store. It is shared by all shards,
+// so a failure in one makes the whole store read-only.
+type health struct {
+	err atomic.Pointer[DegradedError]
+}
+
+// fail records err unless a failure is already recorded, and returns the
+// recorded one.
+func (h *health) fail(err error) error {
+	var de *DegradedError
+	if !errors.As(err, &de) {
+		de = &DegradedError{Cause: err}
+	}
+	h.err.CompareAndSwap(nil, de)
+	return h.err.Load()
+}
+
+func (h *health) check() error {
+	if de := h.err.Load(); de != nil {
+		return de
+	}
+	return nil
+}
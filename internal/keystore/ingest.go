@@ -0,0 +1,209 @@
+package keystore
+
+import (
+	"errors"
+	"os"
+
+	"github.com/Aswin-Sk/MinionDB/internal/SSTables"
+)
+
+// IngestExternalFiles adds tables built offline with SSTables.Writer to the
+// store without passing their records through the WAL or the memtable.
+//
+// Precedence: the ingested records are newer than every write that
+// completed before the call, and when several of the given files hold the
+// same key the one listed last wins. Tombstones in the files delete existing
+// keys. Writes racing with the call may land on either side.
+//
+// The files are split by shard and fully written out before any shard is
+// touched, so a failure while reading or splitting leaves the store
+// unchanged. The shards then take their parts with two-phase commit through
+// the transaction log, as cross-shard batches do, so that even a crash
+// leaves the ingest applied to every shard or to none. A failure once the
+// ingest may have committed leaves the store degraded, and the next open
+// completes or drops it. The source files are left in place.
+func (skv *ShardedKV) IngestExternalFiles(paths []string) error {
+	if err := skv.health.check(); err != nil {
+		return err
+	}
+	var iters []SSTables.Iterator
+	defer func() {
+		for _, it := range iters {
+			it.Close()
+		}
+	}()
+	for _, p := range paths {
+		t, err := SSTables.OpenSSTable(p)
+		if err != nil {
+			return err
+		}
+		it, err := t.NewIterator()
+		if err != nil {
+			return err
+		}
+		iters = append(iters, it)
+	}
+	merged := SSTables.NewMergingIterator(iters...)
+
+	type shardTable struct {
+		num      uint64
+		path     string
+		w        *SSTables.Writer
+		finished bool
+		sst      *SSTables.SSTable
+	}
+	parts := make([]*shardTable, skv.n)
+	abort := func() {
+		for _, p := range parts {
+			switch {
+			case p == nil:
+			case p.sst != nil:
+				p.sst.MarkObsolete()
+				p.sst.Unref()
+			case p.finished:
+				os.Remove(p.path)
+			default:
+				p.w.Abort()
+			}
+		}
+	}
+
+	for merged.Next() {
+		i := skv.shardIndex(merged.Key())
+		if parts[i] == nil {
+			shard := skv.shards[i]
+			num, path, err := shard.newTablePath()
+			if err != nil {
+				abort()
+				return err
+			}
+			w, err := SSTables.NewWriter(path, shard.opts.Table)
+			if err != nil {
+				abort()
+				return err
+			}
+			parts[i] = &shardTable{num: num, path: path, w: w}
+		}
+		if err := parts[i].w.Add(merged.Key(), merged.Value(), merged.Kind()); err != nil {
+			abort()
+			return err
+		}
+	}
+	if err := merged.Err(); err != nil {
+		abort()
+		return err
+	}
+	var shards []*MiniKV
+	for i, p := range parts {
+		if p == nil {
+			continue
+		}
+		err := p.w.Finish()
+		p.finished = true
+		if err == nil {
+			p.sst, err = skv.shards[i].tables.Open(p.path)
+		}
+		if err != nil {
+			abort()
+			return err
+		}
+		shards = append(shards, skv.shards[i])
+	}
+
+	// Every shard taking part is flushed where needed and then locked
+	// before any takes its part, so readers never see the ingest half done.
+	// Checkpoint waits, as it does for a cross-shard batch.
+	skv.ckptMu.RLock()
+	defer skv.ckptMu.RUnlock()
+	for i, p := range parts {
+		if p == nil {
+			continue
+		}
+		db := skv.shards[i]
+		db.flushMu.Lock()
+		defer db.flushMu.Unlock()
+		if err := db.flushOverlapping(p.sst.Properties()); err != nil {
+			abort()
+			return err
+		}
+	}
+	for _, db := range shards {
+		db.mu.Lock()
+		defer db.mu.Unlock()
+	}
+
+	// Each shard logs its part as a prepared manifest edit. The ingest
+	// commits once its id is synced to the transaction log, and only then
+	// do the tables take effect; a shard opened with its part still
+	// prepared takes it or drops it by what the log holds.
+	id := skv.txns.nextIngestID()
+	var prepared []int
+	for i, p := range parts {
+		if p == nil {
+			continue
+		}
+		if err := skv.shards[i].manifest.logAndApply(versionEdit{added: []uint64{p.num}, txn: id}); err != nil {
+			errs := []error{err}
+			for _, j := range prepared {
+				if err := skv.shards[j].manifest.logAndApply(versionEdit{aborted: id}); err != nil {
+					// The shard's manifest still holds the table, so its
+					// file has to stay until the next open drops it.
+					errs = append(errs, err)
+					parts[j].sst.Unref()
+					parts[j] = nil
+				}
+			}
+			abort()
+			return errors.Join(errs...)
+		}
+		prepared = append(prepared, i)
+	}
+	if err := skv.txns.commit(id); err != nil {
+		// The record may have reached the disk regardless; the next open
+		// decides the ingest's fate from whatever it finds.
+		for _, p := range parts {
+			if p != nil {
+				p.sst.Unref()
+			}
+		}
+		return skv.health.fail(err)
+	}
+	var errs []error
+	for i, p := range parts {
+		if p == nil {
+			continue
+		}
+		db := skv.shards[i]
+		if err := db.manifest.logAndApply(versionEdit{committed: id}); err != nil {
+			// The ingest has committed; the shard takes its part when it
+			// is next opened.
+			errs = append(errs, err)
+			p.sst.Unref()
+			continue
+		}
+		db.sstables = append(db.sstables, p.sst)
+	}
+	if err := errors.Join(errs...); err != nil {
+		return skv.health.fail(err)
+	}
+	return nil
+}
+
+// flushOverlapping flushes the memtable if it holds a key in the range of a
+// table about to be installed as the shard's newest, so that the table
+// shadows it. The caller holds flushMu.
+func (db *MiniKV) flushOverlapping(props SSTables.Properties) error {
+	db.mu.RLock()
+	overlaps := false
+	for k := range db.index {
+		if props.Contains(k) {
+			overlaps = true
+			break
+		}
+	}
+	db.mu.RUnlock()
+	if !overlaps {
+		return nil
+	}
+	return db.flushLocked()
+}
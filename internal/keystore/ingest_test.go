@@ -0,0 +1,182 @@
+package keystore
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/Aswin-Sk/MinionDB/internal/SSTables"
+)
+
+func TestIngestExternalFiles(t *testing.T) {
+	dir := t.TempDir()
+	skv, err := NewShardedKV(dir, 2, DefaultOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := keysOnShards(skv, 2)
+	if err := skv.Set(keys[0], []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+	src := filepath.Join(t.TempDir(), "ingest.sst")
+	w, err := SSTables.NewWriter(src, SSTables.DefaultOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range slices.Sorted(slices.Values(keys)) {
+		if err := w.Add(key, []byte("new"), SSTables.KindPut); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Finish(); err != nil {
+		t.Fatal(err)
+	}
+	if err := skv.IngestExternalFiles([]string{src}); err != nil {
+		t.Fatal(err)
+	}
+
+	for range 2 {
+		for _, key := range keys {
+			if val, ok, err := skv.Get(key); err != nil || !ok || string(val) != "new" {
+				t.Fatalf("%s = %q, %v, %v; want new", key, val, ok, err)
+			}
+		}
+		if err := skv.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if skv, err = NewShardedKV(dir, 2, DefaultOptions()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	skv.Close()
+}
+
+// An ingest is decided by the transaction log: one whose commit record
+// reached it takes effect on every shard after a crash before any shard
+// logged its commit edit, and one whose commit record did not is dropped
+// along with its tables.
+func TestIngestCrashBeforeShardCommitEdits(t *testing.T) {
+	for _, committed := range []bool{true, false} {
+		t.Run(fmt.Sprintf("committed=%v", committed), func(t *testing.T) {
+			dir := t.TempDir()
+			skv, err := NewShardedKV(dir, 2, DefaultOptions())
+			if err != nil {
+				t.Fatal(err)
+			}
+			keys := keysOnShards(skv, 2)
+
+			// IngestExternalFiles up to its commit edits.
+			id := skv.txns.nextIngestID()
+			var tables []string
+			for i, s := range skv.shards {
+				num, path, err := s.newTablePath()
+				if err != nil {
+					t.Fatal(err)
+				}
+				recs := []memRecord{{key: keys[i], Entry: SSTables.Entry{Kind: SSTables.KindPut, Value: []byte("v")}}}
+				if err := writeTableFile(path, recs, 1, 0, s.opts.Table); err != nil {
+					t.Fatal(err)
+				}
+				if err := s.manifest.logAndApply(versionEdit{added: []uint64{num}, txn: id}); err != nil {
+					t.Fatal(err)
+				}
+				tables = append(tables, path)
+			}
+			if committed {
+				if err := skv.txns.commit(id); err != nil {
+					t.Fatal(err)
+				}
+			}
+			crash(t, skv)
+
+			// The second open finds the outcomes recorded by the first in
+			// the manifests, and an empty transaction log.
+			for range 2 {
+				skv, err = NewShardedKV(dir, 2, DefaultOptions())
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, key := range keys {
+					if _, ok, err := skv.Get(key); err != nil || ok != committed {
+						t.Fatalf("%s present = %v, %v; want %v", key, ok, err, committed)
+					}
+				}
+				for _, path := range tables {
+					if _, err := os.Stat(path); (err == nil) != committed {
+						t.Fatalf("table %s kept = %v, want %v", path, err == nil, committed)
+					}
+				}
+				crash(t, skv)
+			}
+		})
+	}
+}
+
+// writeIngestFile writes recs, which must be in key order, as a table to
+// ingest.
+func writeIngestFile(t *testing.T, recs ...memRecord) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "ingest.sst")
+	w, err := SSTables.NewWriter(path, SSTables.DefaultOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range recs {
+		if err := w.Add(r.key, r.Value, r.Kind); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Finish(); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func put(key, val string) memRecord {
+	return memRecord{key: key, Entry: SSTables.Entry{Kind: SSTables.KindPut, Value: []byte(val)}}
+}
+
+func del(key string) memRecord {
+	return memRecord{key: key, Entry: SSTables.Entry{Kind: SSTables.KindDelete}}
+}
+
+func TestIngestPrecedence(t *testing.T) {
+	skv, err := NewShardedKV(t.TempDir(), 2, DefaultOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer skv.Close()
+	for _, key := range []string{"a", "b"} {
+		if err := skv.Set(key, []byte("old")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	first := writeIngestFile(t, del("a"), put("c", "first"))
+	last := writeIngestFile(t, put("c", "last"), del("d"))
+	if err := skv.IngestExternalFiles([]string{first, last}); err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]string{"a": "", "b": "old", "c": "last", "d": ""} {
+		val, ok, err := skv.Get(key)
+		if err != nil || ok != (want != "") || string(val) != want {
+			t.Fatalf("%s = %q, %v, %v; want %q", key, val, ok, err, want)
+		}
+	}
+
+	// A file that cannot be read leaves the store as it was.
+	bad := filepath.Join(t.TempDir(), "bad.sst")
+	if err := os.WriteFile(bad, []byte("not a table"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := skv.IngestExternalFiles([]string{writeIngestFile(t, put("b", "new")), bad}); err == nil {
+		t.Fatal("ingested a file that is not a table")
+	}
+	if val, ok, err := skv.Get("b"); err != nil || !ok || string(val) != "old" {
+		t.Fatalf("b = %q, %v, %v after a failed ingest; want old", val, ok, err)
+	}
+	if err := skv.Err(); err != nil {
+		t.Fatalf("failed ingest degraded the store: %v", err)
+	}
+}
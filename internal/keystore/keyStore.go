@@ -1,57 +1,255 @@
 package keystore
 
 import (
-	"encoding/binary"
+	"context"
 	"errors"
-	"fmt"
-	"io"
+	"maps"
+	"math"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
-	"unsafe"
 
 	"github.com/Aswin-Sk/MinionDB/internal/SSTables"
+	"github.com/Aswin-Sk/MinionDB/internal/fileformat"
 	"github.com/Aswin-Sk/MinionDB/internal/logger"
 )
 
-const Tombstone = "__deleted__"
-
 const maxInMemoryEntries = 1000
 
+// Options configures every shard of a ShardedKV.
+type Options struct {
+	Table SSTables.Options
+	// MaxOpenFiles bounds the table files held open across all shards.
+	MaxOpenFiles int
+	// Mmap serves table reads from memory-mapped files where the platform
+	// supports it.
+	Mmap bool
+	// BlockCacheSize is the byte budget of the block cache shared by all
+	// shards. Zero disables the cache.
+	BlockCacheSize int64
+	// WALRecovery decides how damaged WAL records are handled on open.
+	WALRecovery WALRecoveryMode
+	// Durability decides when the WAL is synced; SyncInterval is the
+	// longest a write stays unsynced under the SyncInterval mode.
+	Durability   Durability
+	SyncInterval time.Duration
+	// WALBatchSize and WALBatchInterval bound how many writes are grouped
+	// into one WAL write and how long a write waits for the group to fill.
+	WALBatchSize     int
+	WALBatchInterval time.Duration
+	// WALSegmentSize is the size at which writes move on to a new WAL
+	// segment. Zero keeps one segment per memtable.
+	WALSegmentSize int64
+	// WALRetention is how long segments are kept once their writes are in
+	// tables, for subscribers to read. Expired segments are deleted when a
+	// memtable is flushed.
+	WALRetention time.Duration
+	// WALArchiveDir, if set, receives a copy of every segment once writes
+	// have moved on from it, for Restore. Segments are archived before they
+	// are deleted.
+	WALArchiveDir string
+	// ReadUncommitted applies writes to the memtable before they are
+	// logged rather than after, so readers may see a write that a crash or
+	// a failed sync then loses.
+	ReadUncommitted bool
+}
+
+func DefaultOptions() Options {
+	return Options{
+		Table:            SSTables.DefaultOptions(),
+		MaxOpenFiles:     1000,
+		BlockCacheSize:   8 << 20,
+		Durability:       SyncEveryBatch,
+		SyncInterval:     100 * time.Millisecond,
+		WALBatchSize:     128,
+		WALBatchInterval: 5 * time.Millisecond,
+		WALSegmentSize:   4 << 20,
+	}
+}
+
 type MiniKV struct {
-	mu            sync.RWMutex
-	index         map[string][]byte
-	wb            *WriteBatcher
-	sstables      []SSTables.SSTable
+	mu    sync.RWMutex
+	index map[string]SSTables.Entry
+	// imm is the memtable being flushed, if any. It sits between index
+	// and the tables for reads.
+	imm map[string]SSTables.Entry
+	// walMu is held shared while a write is queued on wb and exclusively
+	// while wb is switched, so a retired WAL never receives new writes.
+	walMu sync.RWMutex
+	// txnMu is held shared by every write and exclusively by a cross-shard
+	// batch, so that no other write comes between its prepare record and
+	// its commit record.
+	txnMu   sync.RWMutex
+	wb      *WriteBatcher
+	flushMu sync.Mutex
+	// flushing tracks the flushes started in the background for writers
+	// that do not wait for one, and flushQueued is set while one is.
+	flushing    sync.WaitGroup
+	flushQueued atomic.Bool
+	// archiveMu serialises archiving with the deletion of segments, and
+	// archiving tracks the copies running in the background.
+	archiveMu     sync.Mutex
+	archiving     sync.WaitGroup
+	sstables      []*SSTables.SSTable
+	tables        *SSTables.TableCache
+	health        *health
+	log           *shardLog
+	manifest      *manifest
 	baseDirectory string
+	opts          Options
+}
+
+// open opens the shard at path, first resolving the cross-shard ingests it
+// held prepared. It returns the outcomes of the cross-shard batches the
+// shard held prepared, which logOutcomes logs once every shard has raised
+// the sequence past the numbers it used.
+func open(path string, opts Options, tables *SSTables.TableCache, h *health, log *shardLog, committed map[uint64]bool) (*MiniKV, []batchOp, error) {
+	if err := CreateDirs(path); err != nil {
+		return nil, nil, err
+	}
+	// Opening would carry on without the writes and tables they hold.
+	legacy, err := legacyFiles(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(legacy) > 0 {
+		return nil, nil, &fileformat.Error{Path: legacy[0], Err: fileformat.ErrLegacyFormat}
+	}
+	man, err := openManifest(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Ingests left prepared take effect if the transaction log holds their
+	// commit record.
+	if err := man.resolve(committed); err != nil {
+		man.close()
+		return nil, nil, err
+	}
+	log.newSegment = man.newWALPath
+	db, outcomes, err := recoverShard(path, man, opts, tables, log, committed)
+	if err != nil {
+		man.close()
+		return nil, nil, err
+	}
+	db.health = h
+	log.sealed = db.archiveSealed
+	if !opts.ReadUncommitted {
+		log.apply = db.applyLogged
+	}
+	// Segments sealed by the last run may not have been archived before it
+	// ended.
+	db.archiveSealed()
+	if err := man.removeObsoleteFiles(); err != nil {
+		logger.Logger.Warn("removing obsolete files", "path", path, "error", err)
+	}
+	if err := db.trimWAL(); err != nil {
+		logger.Logger.Warn("trimming WAL", "path", path, "error", err)
+	}
+	return db, outcomes, nil
 }
 
-func open(path string) (*MiniKV, error) {
-	CreateDirs(path)
-	index := make(map[string][]byte)
+// recoverShard opens the tables listed in the manifest and replays every WAL
+// segment from the manifest's log number onwards, oldest first, skipping
+// records already flushed. New writes go to a freshly numbered segment.
+// Cross-shard batches left prepared are applied if committed holds their
+// id and dropped otherwise.
+func recoverShard(path string, man *manifest, opts Options, tables *SSTables.TableCache, log *shardLog, committed map[uint64]bool) (*MiniKV, []batchOp, error) {
+	v := man.current()
+	sstables := make([]*SSTables.SSTable, 0, len(v.tables))
+	for _, num := range v.tables {
+		sst, err := tables.Open(tableFileName(path, num))
+		if err != nil {
+			return nil, nil, err
+		}
+		sstables = append(sstables, sst)
+	}
 
-	walPath, err := getWALPath(path)
+	logs, err := liveWALs(path, v.logNum)
 	if err != nil {
-		if err != ErrWalExists {
-			return nil, err
+		return nil, nil, err
+	}
+	r := &walReplay{
+		mem:     make(map[string]SSTables.Entry),
+		pending: make(map[uint64][]batchOp),
+		flushed: v.flushedSeq,
+		until:   math.MaxUint64,
+		lastSeq: v.flushedSeq,
+	}
+	for _, num := range logs {
+		if err := ReplayWAL(walFileName(path, num), opts.WALRecovery, r); err != nil {
+			return nil, nil, err
 		}
-		index, err = ReplayWAL(walPath)
-		if err != nil {
-			return nil, err
+	}
+	log.seq.Store(max(log.seq.Load(), r.lastSeq, v.trimmedSeq))
+	var outcomes []batchOp
+	for _, id := range slices.Sorted(maps.Keys(r.pending)) {
+		op := opAbort
+		if committed[id] {
+			applyOps(r.mem, r.pending[id])
+			op = opCommit
 		}
+		outcomes = append(outcomes, batchOp{t: op, key: txnKey(id)})
 	}
-	wb, err := NewWriteBatcher(walPath, 128, 5*time.Millisecond)
+
+	logNum, err := man.newFileNum()
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	if v.logNum == 0 {
+		if err := man.logAndApply(versionEdit{logNum: logNum}); err != nil {
+			return nil, nil, err
+		}
+	}
+	wb, err := NewWriteBatcher(walFileName(path, logNum), opts, log)
+	if err != nil {
+		return nil, nil, err
 	}
+	// The batches still prepared are resolved by the outcomes logged next,
+	// and their events are published then.
+	wb.prepared = r.pending
 
 	return &MiniKV{
-		index:         index,
+		index:         r.mem,
 		wb:            wb,
+		sstables:      sstables,
+		tables:        tables,
+		manifest:      man,
+		log:           log,
 		baseDirectory: path,
-	}, nil
+		opts:          opts,
+	}, outcomes, nil
+}
+
+// logOutcomes logs the resolution of the cross-shard batches left prepared
+// when the shard was opened.
+func (db *MiniKV) logOutcomes(outcomes []batchOp) error {
+	for _, op := range outcomes {
+		if err := db.wb.enqueue([]batchOp{op}, WriteOptions{Sync: true}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// liveWALs returns the numbers of the WAL files at or after logNum, in
+// ascending order.
+func liveWALs(path string, logNum uint64) ([]uint64, error) {
+	entries, err := os.ReadDir(filepath.Join(path, "wal"))
+	if err != nil {
+		return nil, err
+	}
+	var nums []uint64
+	for _, ent := range entries {
+		if typ, num, ok := parseFileName(ent.Name()); ok && typ == fileWAL && num >= logNum {
+			nums = append(nums, num)
+		}
+	}
+	slices.Sort(nums)
+	return nums, nil
 }
 
 func CreateDirs(base string) error {
@@ -67,148 +265,497 @@ func CreateDirs(base string) error {
 }
 
 func (db *MiniKV) Set(key string, val []byte) error {
+	return db.SetWithOptions(key, val, WriteOptions{})
+}
+
+func (db *MiniKV) SetWithOptions(key string, val []byte, wo WriteOptions) error {
+	return db.apply(context.Background(), []batchOp{{t: opSet, key: key, val: append([]byte(nil), val...)}}, wo, true)
+}
+
+// SetCtx is Set that fails with ErrBusy rather than wait for a full WAL
+// queue, leaves a flush of a full memtable to the background, and stops
+// waiting, for a cross-shard batch or memtable switch holding the shard or
+// for the write to be logged, once ctx is done.
+func (db *MiniKV) SetCtx(ctx context.Context, key string, val []byte) error {
+	return db.apply(ctx, []batchOp{{t: opSet, key: key, val: append([]byte(nil), val...)}}, WriteOptions{}, false)
+}
+
+// SetAsync is Set that returns once the write is queued for the WAL,
+// without waiting for it to be logged.
+func (db *MiniKV) SetAsync(key string, val []byte) *WriteFuture {
+	return db.start(context.Background(), []batchOp{{t: opSet, key: key, val: append([]byte(nil), val...)}}, WriteOptions{}, true)
+}
+
+// apply writes ops with start and waits for them to be logged. A write
+// whose ctx is done meanwhile still completes; only the wait is cut short,
+// and the batcher marks the store degraded if the write then fails.
+func (db *MiniKV) apply(ctx context.Context, ops []batchOp, wo WriteOptions, block bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	f := db.start(ctx, ops, wo, block)
+	select {
+	case <-f.Done():
+		return f.Wait()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// start queues ops to be logged as one WAL record, which the batcher then
+// applies to the memtable under a single lock, so readers see all of them
+// or none and only once they are logged. Under ReadUncommitted they are
+// applied here instead, as soon as they have a place in the queue. If block
+// is false, start fails with ErrBusy, and nothing is written, if the queue
+// is full, waits for a cross-shard batch or a memtable switch holding the
+// shard only until ctx is done, and flushes a full memtable in the
+// background.
+func (db *MiniKV) start(ctx context.Context, ops []batchOp, wo WriteOptions, block bool) *WriteFuture {
+	if err := db.health.check(); err != nil {
+		return FailedWrite(err)
+	}
+	if !block {
+		if err := rlockCtx(ctx, &db.txnMu); err != nil {
+			return FailedWrite(err)
+		}
+		defer db.txnMu.RUnlock()
+		db.flushInBackground()
+		if err := rlockCtx(ctx, &db.walMu); err != nil {
+			return FailedWrite(err)
+		}
+		defer db.walMu.RUnlock()
+		return db.queue(ops, wo, false)
+	}
+	db.txnMu.RLock()
+	defer db.txnMu.RUnlock()
+	if err := db.CheckIfFlushNeeded(); err != nil {
+		return FailedWrite(err)
+	}
+	db.walMu.RLock()
+	defer db.walMu.RUnlock()
+	return db.queue(ops, wo, true)
+}
+
+// rlockCtx takes mu shared, giving up with ctx's error once ctx is done. A
+// lock taken after that is released straight away.
+func rlockCtx(ctx context.Context, mu *sync.RWMutex) error {
+	if mu.TryRLock() {
+		return nil
+	}
+	locked := make(chan struct{})
+	go func() {
+		mu.RLock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		return nil
+	case <-ctx.Done():
+		go func() {
+			<-locked
+			mu.RUnlock()
+		}()
+		return ctx.Err()
+	}
+}
+
+// queue is start for a caller that holds txnMu and walMu.
+func (db *MiniKV) queue(ops []batchOp, wo WriteOptions, block bool) *WriteFuture {
+	if err := db.wb.reserve(block); err != nil {
+		return FailedWrite(err)
+	}
+	if db.opts.ReadUncommitted {
+		db.mu.Lock()
+		applyOps(db.index, ops)
+		db.mu.Unlock()
+	}
+	return db.wb.submit(ops, wo)
+}
+
+// applyLogged applies records logged by the batcher to the memtable, in
+// order. Cross-shard batches are applied by commit instead, on every shard
+// at once.
+func (db *MiniKV) applyLogged(recs [][]batchOp) {
 	db.mu.Lock()
-	db.index[key] = append([]byte(nil), val...)
-	db.mu.Unlock()
-	err := db.CheckIfFlushNeeded()
+	defer db.mu.Unlock()
+	for _, ops := range recs {
+		if ops[0].t <= opDel {
+			applyOps(db.index, ops)
+		}
+	}
+}
+
+// logged passes on the result of a WAL write, first marking the store
+// degraded if the write failed.
+func (db *MiniKV) logged(err error) error {
 	if err != nil {
-		return err
+		return db.health.fail(err)
 	}
-	return db.wb.EnqueueSet(key, val)
+	return nil
+}
+
+func (db *MiniKV) Get(key string) ([]byte, bool, error) {
+	return db.GetWithOptions(key, SSTables.DefaultReadOptions())
 }
 
-func (db *MiniKV) Get(key string) ([]byte, bool) {
+func (db *MiniKV) GetWithOptions(key string, ro SSTables.ReadOptions) ([]byte, bool, error) {
 	db.mu.RLock()
-	v, ok := db.index[key]
-	db.mu.RUnlock()
+	e, ok := db.index[key]
+	if !ok && db.imm != nil {
+		e, ok = db.imm[key]
+	}
 	if ok {
-		return v, true
+		db.mu.RUnlock()
+		if e.Kind == SSTables.KindDelete {
+			return nil, false, nil
+		}
+		return e.Value, true, nil
 	}
-	for i := len(db.sstables) - 1; i >= 0; i-- {
-		v, ok, err := SSTables.ReadSSTable(db.sstables[i].Path, key)
+	// The tables are referenced so that a compaction finishing meanwhile
+	// cannot remove their files from under the lookup.
+	sstables := slices.Clone(db.sstables)
+	for _, t := range sstables {
+		t.Ref()
+	}
+	db.mu.RUnlock()
+	defer unrefTables(sstables)
+
+	for i := len(sstables) - 1; i >= 0; i-- {
+		v, kind, ok, err := sstables[i].GetWithOptions(key, ro)
 		if err != nil {
-			logger.Logger.Error("Error reading SSTable:", "error", err)
-			continue
+			return nil, false, err
 		}
 		if ok {
-			return v, true
+			// A tombstone hides the key in every older table.
+			if kind == SSTables.KindDelete {
+				return nil, false, nil
+			}
+			return v, true, nil
 		}
 	}
-	return nil, false
+	return nil, false, nil
+}
+
+// GetCtx is Get that returns once ctx is done. A lookup stuck reading a
+// table cannot be interrupted and finishes in the background.
+func (db *MiniKV) GetCtx(ctx context.Context, key string) ([]byte, bool, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, false, err
+	}
+	type result struct {
+		val []byte
+		ok  bool
+		err error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		val, ok, err := db.Get(key)
+		ch <- result{val, ok, err}
+	}()
+	select {
+	case r := <-ch:
+		return r.val, r.ok, r.err
+	case <-ctx.Done():
+		return nil, false, ctx.Err()
+	}
 }
 
 func (db *MiniKV) Delete(key string) error {
-	db.mu.Lock()
-	db.index[key] = []byte(Tombstone)
-	db.mu.Unlock()
-	return db.wb.EnqueueDel(key)
+	return db.DeleteWithOptions(key, WriteOptions{})
+}
+
+func (db *MiniKV) DeleteWithOptions(key string, wo WriteOptions) error {
+	return db.apply(context.Background(), []batchOp{{t: opDel, key: key}}, wo, true)
+}
+
+// DeleteAsync is Delete that does not wait for the write to be logged.
+func (db *MiniKV) DeleteAsync(key string) *WriteFuture {
+	return db.start(context.Background(), []batchOp{{t: opDel, key: key}}, WriteOptions{}, true)
 }
 
+// DeleteCtx is Delete with the queueing and cancellation of SetCtx.
+func (db *MiniKV) DeleteCtx(ctx context.Context, key string) error {
+	return db.apply(ctx, []batchOp{{t: opDel, key: key}}, WriteOptions{}, false)
+}
+
+// Close flushes the memtable and closes the shard. A degraded shard is
+// closed without flushing: its memtable may hold writes that were reported
+// as failed, and the WAL is replayed on the next open instead. Every file
+// is closed even if a step fails, and all the errors are returned.
 func (db *MiniKV) Close() error {
-	err := db.flushToSSTable()
-	if err != nil {
-		return err
+	db.flushing.Wait()
+	var errs []error
+	if db.health.check() == nil {
+		errs = append(errs, db.flushMemtable())
 	}
-	return db.wb.Close()
+	errs = append(errs, db.wb.Close())
+	db.archiving.Wait()
+	errs = append(errs, db.archiveWAL(math.MaxUint64), db.manifest.close())
+	return errors.Join(errs...)
 }
 
-func (db *MiniKV) swapWriteBatcher(newBatcher *WriteBatcher) *WriteBatcher {
-	old := db.wb
-	atomic.StorePointer((*unsafe.Pointer)(unsafe.Pointer(&db.wb)), unsafe.Pointer(newBatcher))
-	return old
+// flushMemtable moves the memtable into a new SSTable. Writes are switched
+// to a fresh WAL segment and memtable first, so they are not blocked while
+// the old memtable is written out; the old segments are dropped once the
+// table and the last sequence number it covers are recorded in the
+// manifest.
+func (db *MiniKV) flushMemtable() error {
+	db.flushMu.Lock()
+	defer db.flushMu.Unlock()
+	return db.flushLocked()
 }
 
-func (db *MiniKV) flushToSSTable() error {
-	if len(db.sstables) >= 5 {
-		return errors.New("too many SSTables")
+func (db *MiniKV) flushLocked() error {
+	if err := db.health.check(); err != nil {
+		return err
 	}
 	db.mu.RLock()
-	snapshot := make(map[string][]byte, len(db.index))
-	for k, v := range db.index {
-		snapshot[k] = append([]byte(nil), v...)
-	}
+	empty := len(db.index) == 0
 	db.mu.RUnlock()
-
-	if len(snapshot) == 0 {
+	if empty {
 		return nil
 	}
 
-	ssTablePath := db.nextSSTablePath()
-	err := SSTables.WriteSSTable(ssTablePath, snapshot)
+	newLog, err := db.manifest.newFileNum()
+	if err != nil {
+		return err
+	}
+	flushedSeq := db.manifest.current().flushedSeq
+	newBatcher, err := NewWriteBatcher(walFileName(db.baseDirectory, newLog), db.opts, db.log)
 	if err != nil {
 		return err
 	}
+	db.walMu.Lock()
+	old := db.wb
+	db.wb = newBatcher
+	// old takes no more writes. Closing it settles its last sequence number
+	// and applies the writes still queued on it to the memtable being
+	// retired. If its last sync fails, writes acknowledged without one may
+	// be lost, so the memtable is not flushed over them.
+	if err := old.Close(); err != nil {
+		db.walMu.Unlock()
+		return db.health.fail(err)
+	}
 	db.mu.Lock()
-	db.sstables = append(db.sstables, SSTables.SSTable{Path: ssTablePath})
+	db.imm, db.index = db.index, make(map[string]SSTables.Entry)
 	db.mu.Unlock()
-	return nil
-}
+	db.walMu.Unlock()
+	db.archiveSealed()
 
-func (db *MiniKV) CheckIfFlushNeeded() error {
-	if len(db.index) >= maxInMemoryEntries {
-		return db.flushToSSTable()
+	num, sst, err := db.writeTable(sortedRecords(db.imm), flushedSeq+1, old.LastSeq())
+	if err == nil {
+		db.mu.Lock()
+		err = db.manifest.logAndApply(versionEdit{added: []uint64{num}, logNum: newLog, flushedSeq: old.LastSeq()})
+		if err == nil {
+			db.sstables = append(db.sstables, sst)
+			db.imm = nil
+		}
+		db.mu.Unlock()
+	}
+	if err != nil {
+		// Fold the old memtable back in under any newer writes. Its WAL
+		// segments stay live because the manifest's log number did not
+		// move.
+		db.mu.Lock()
+		for k, e := range db.imm {
+			if _, ok := db.index[k]; !ok {
+				db.index[k] = e
+			}
+		}
+		db.imm = nil
+		db.mu.Unlock()
+		return err
+	}
+
+	if err := db.trimWAL(); err != nil {
+		logger.Logger.Warn("trimming WAL", "path", db.baseDirectory, "error", err)
 	}
 	return nil
 }
 
-func (db *MiniKV) nextSSTablePath() string {
-	sstDir := filepath.Join(db.baseDirectory, "sstables")
-	id := len(db.sstables) + 1
-	return filepath.Join(sstDir, fmt.Sprintf("sst-%05d.sst", id))
+// trimWAL deletes, oldest first, the WAL segments whose writes are all in
+// tables and that are older than the retention period, after archiving them
+// and recording the last sequence number they held.
+func (db *MiniKV) trimWAL() error {
+	db.archiveMu.Lock()
+	defer db.archiveMu.Unlock()
+	v := db.manifest.current()
+	nums, err := liveWALs(db.baseDirectory, 0)
+	if err != nil {
+		return err
+	}
+	var doomed []string
+	var trimmed uint64
+	for _, num := range nums {
+		if num >= v.logNum {
+			break
+		}
+		path := walFileName(db.baseDirectory, num)
+		if db.opts.WALRetention > 0 {
+			st, err := os.Stat(path)
+			if err != nil {
+				return err
+			}
+			if time.Since(st.ModTime()) < db.opts.WALRetention {
+				break
+			}
+		}
+		last, err := lastSeqOf(path)
+		if err != nil {
+			// Nothing in the segment is newer than the flushed writes.
+			logger.Logger.Warn("reading WAL segment", "path", path, "error", err)
+			last = v.flushedSeq
+		}
+		trimmed = max(trimmed, last)
+		doomed = append(doomed, path)
+	}
+	if dir := db.archiveDir(); dir != "" {
+		for _, path := range doomed {
+			if err := archiveSegment(path, dir); err != nil {
+				return err
+			}
+		}
+	}
+	if trimmed > 0 {
+		if err := db.manifest.logAndApply(versionEdit{trimmedSeq: trimmed}); err != nil {
+			return err
+		}
+	}
+	var errs []error
+	for _, path := range doomed {
+		errs = append(errs, os.Remove(path))
+	}
+	return errors.Join(errs...)
 }
 
-func ReplayWAL(path string) (map[string][]byte, error) {
-	f, err := os.Open(path)
+// walSegments returns the paths of the shard's WAL segments, oldest first.
+func (db *MiniKV) walSegments() ([]string, error) {
+	nums, err := liveWALs(db.baseDirectory, 0)
 	if err != nil {
 		return nil, err
 	}
-	defer f.Close()
+	paths := make([]string, len(nums))
+	for i, num := range nums {
+		paths[i] = walFileName(db.baseDirectory, num)
+	}
+	return paths, nil
+}
 
-	index := make(map[string][]byte)
-	var op [1]byte
-	var klenBuf, vlenBuf [4]byte
+type memRecord struct {
+	key string
+	SSTables.Entry
+}
 
-	for {
-		// read op
-		_, err := f.Read(op[:])
-		if err != nil {
-			if errors.Is(err, io.EOF) {
-				break
-			}
-			return nil, err
-		}
+// sortedRecords returns mem in key order. Entries are never modified once
+// inserted, so the values are shared rather than copied.
+func sortedRecords(mem map[string]SSTables.Entry) []memRecord {
+	recs := make([]memRecord, 0, len(mem))
+	for k, e := range mem {
+		recs = append(recs, memRecord{key: k, Entry: e})
+	}
+	slices.SortFunc(recs, func(a, b memRecord) int { return strings.Compare(a.key, b.key) })
+	return recs
+}
 
-		// read key length
-		if _, err := f.Read(klenBuf[:]); err != nil {
-			return nil, err
-		}
-		klen := binary.LittleEndian.Uint32(klenBuf[:])
+// writeTable streams recs, which must be sorted, into a newly numbered
+// table and opens it. The table is not yet part of the shard's version.
+func (db *MiniKV) writeTable(recs []memRecord, smallestSeq, largestSeq uint64) (uint64, *SSTables.SSTable, error) {
+	num, path, err := db.newTablePath()
+	if err != nil {
+		return 0, nil, err
+	}
+	if err := writeTableFile(path, recs, smallestSeq, largestSeq, db.opts.Table); err != nil {
+		return 0, nil, err
+	}
+	sst, err := db.tables.Open(path)
+	if err != nil {
+		return 0, nil, err
+	}
+	return num, sst, nil
+}
 
-		var vlen uint32
-		if op[0] == byte(opSet) {
-			if _, err := f.Read(vlenBuf[:]); err != nil {
-				return nil, err
-			}
-			vlen = binary.LittleEndian.Uint32(vlenBuf[:])
+// writeTableFile writes recs, which must be sorted and come from the
+// records numbered smallestSeq to largestSeq, as a table at path.
+func writeTableFile(path string, recs []memRecord, smallestSeq, largestSeq uint64, opts SSTables.Options) error {
+	w, err := SSTables.NewWriter(path, opts)
+	if err != nil {
+		return err
+	}
+	// Records numbered zero, replayed from logs written before records
+	// were numbered, can leave the range empty.
+	if smallestSeq <= largestSeq {
+		w.SetSeqRange(smallestSeq, largestSeq)
+	}
+	for _, r := range recs {
+		if err := w.Add(r.key, r.Value, r.Kind); err != nil {
+			w.Abort()
+			return err
 		}
+	}
+	return w.Finish()
+}
 
-		// read key
-		key := make([]byte, klen)
-		if _, err := io.ReadFull(f, key); err != nil {
-			return nil, err
+// flushInBackground starts CheckIfFlushNeeded in the background if the
+// memtable is full and no such flush is under way.
+func (db *MiniKV) flushInBackground() {
+	db.mu.RLock()
+	full := len(db.index) >= maxInMemoryEntries
+	db.mu.RUnlock()
+	if !full || !db.flushQueued.CompareAndSwap(false, true) {
+		return
+	}
+	db.flushing.Add(1)
+	go func() {
+		defer db.flushing.Done()
+		defer db.flushQueued.Store(false)
+		if err := db.CheckIfFlushNeeded(); err != nil {
+			logger.Logger.Warn("flushing memtable", "path", db.baseDirectory, "error", err)
 		}
+	}()
+}
 
-		if op[0] == byte(opSet) {
-			// read value
-			val := make([]byte, vlen)
-			if _, err := io.ReadFull(f, val); err != nil {
-				return nil, err
-			}
-			index[string(key)] = val
-		} else if op[0] == byte(opDel) {
-			delete(index, string(key))
+// CheckIfFlushNeeded flushes the memtable once it is full. Only one caller
+// flushes; the others carry on writing into the fresh memtable.
+func (db *MiniKV) CheckIfFlushNeeded() error {
+	db.mu.RLock()
+	full := len(db.index) >= maxInMemoryEntries
+	db.mu.RUnlock()
+	if !full || !db.flushMu.TryLock() {
+		return nil
+	}
+	defer db.flushMu.Unlock()
+
+	db.mu.RLock()
+	full = len(db.index) >= maxInMemoryEntries
+	tables := len(db.sstables)
+	db.mu.RUnlock()
+	if !full {
+		return nil
+	}
+	if tables >= 5 {
+		return errors.New("too many SSTables")
+	}
+	return db.flushLocked()
+}
+
+func (db *MiniKV) newTablePath() (uint64, string, error) {
+	num, err := db.manifest.newFileNum()
+	if err != nil {
+		return 0, "", err
+	}
+	return num, tableFileName(db.baseDirectory, num), nil
+}
+
+func unrefTables(tables []*SSTables.SSTable) {
+	for _, t := range tables {
+		if err := t.Unref(); err != nil {
+			logger.Logger.Warn("removing obsolete table", "path", t.Path, "error", err)
 		}
 	}
+}
 
-	return index, nil
+// tableNum recovers the file number a table was created under.
+func tableNum(t *SSTables.SSTable) uint64 {
+	_, num, _ := parseFileName(filepath.Base(t.Path))
+	return num
 }
@@ -0,0 +1,270 @@
+package keystore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestSetCtxWaitsForShard(t *testing.T) {
+	skv, err := NewShardedKV(t.TempDir(), 1, DefaultOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer skv.Close()
+	db := skv.shards[0]
+
+	// As a cross-shard batch does, for longer than the write waits.
+	db.txnMu.Lock()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	err = skv.SetCtx(ctx, "k", []byte("v"))
+	cancel()
+	db.txnMu.Unlock()
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("SetCtx outlasted by a cross-shard batch: got %v, want DeadlineExceeded", err)
+	}
+	if _, ok, err := skv.Get("k"); err != nil || ok {
+		t.Fatalf("timed-out write applied: %v, %v", ok, err)
+	}
+
+	// As a memtable switch does, for less time than the write waits.
+	db.walMu.Lock()
+	time.AfterFunc(20*time.Millisecond, db.walMu.Unlock)
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := skv.SetCtx(ctx, "k", []byte("v")); err != nil {
+		t.Fatalf("SetCtx during a memtable switch: %v", err)
+	}
+
+	// Only a full queue makes the write fail at once.
+	for range cap(db.wb.slots) {
+		db.wb.slots <- struct{}{}
+	}
+	err = skv.DeleteCtx(ctx, "k")
+	for range cap(db.wb.slots) {
+		<-db.wb.slots
+	}
+	if !errors.Is(err, ErrBusy) {
+		t.Fatalf("DeleteCtx on a full queue: got %v, want ErrBusy", err)
+	}
+	if _, ok, err := skv.Get("k"); err != nil || !ok {
+		t.Fatalf("refused delete applied: %v, %v", ok, err)
+	}
+}
+
+func TestSetCtxFlushesInBackground(t *testing.T) {
+	opts := DefaultOptions()
+	opts.WALBatchSize = 1
+	opts.Durability = NoSync
+	skv, err := NewShardedKV(t.TempDir(), 1, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer skv.Close()
+	db := skv.shards[0]
+
+	for i := range maxInMemoryEntries + 1 {
+		if err := skv.SetCtx(context.Background(), fmt.Sprintf("k%04d", i), []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.flushing.Wait()
+	db.mu.RLock()
+	tables := len(db.sstables)
+	db.mu.RUnlock()
+	if tables == 0 {
+		t.Fatal("full memtable was not flushed")
+	}
+}
+
+func TestFlushRecordsSeqRange(t *testing.T) {
+	skv, err := NewShardedKV(t.TempDir(), 1, DefaultOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer skv.Close()
+	db := skv.shards[0]
+	for round := range 2 {
+		first := skv.seq.Load() + 1
+		for i := range 3 {
+			if err := skv.Set(fmt.Sprintf("k%d", i), []byte("v")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := db.flushMemtable(); err != nil {
+			t.Fatal(err)
+		}
+		p := db.sstables[round].Properties()
+		if p.SmallestSeq != first || p.LargestSeq != skv.seq.Load() {
+			t.Fatalf("table %d holds seqs %d-%d, want %d-%d", round, p.SmallestSeq, p.LargestSeq, first, skv.seq.Load())
+		}
+	}
+}
+
+// breakWAL makes every later write to db's WAL fail.
+func breakWAL(db *MiniKV) {
+	db.wb.mu.Lock()
+	db.wb.file.Close()
+	db.wb.mu.Unlock()
+}
+
+func TestWALFailureDegradesWithoutWait(t *testing.T) {
+	skv, err := NewShardedKV(t.TempDir(), 1, DefaultOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer skv.Close()
+	breakWAL(skv.shards[0])
+
+	<-skv.SetAsync("b", []byte("v")).Done()
+	if err := skv.Err(); !errors.Is(err, ErrDegraded) {
+		t.Fatalf("Err after a failed write nobody waited for: %v", err)
+	}
+	if err := skv.Set("c", []byte("v")); !errors.Is(err, ErrDegraded) {
+		t.Fatalf("Set on a degraded store: %v", err)
+	}
+}
+
+func TestSetCtxTimedOutWriteFailureDegrades(t *testing.T) {
+	// The write sits in the queue until the interval ends.
+	opts := DefaultOptions()
+	opts.WALBatchSize = 1 << 20
+	opts.WALBatchInterval = 200 * time.Millisecond
+	skv, err := NewShardedKV(t.TempDir(), 1, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer skv.Close()
+	db := skv.shards[0]
+	breakWAL(db)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := skv.SetCtx(ctx, "b", []byte("v")); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("SetCtx: got %v, want DeadlineExceeded", err)
+	}
+	db.wb.drain()
+	if err := skv.Err(); !errors.Is(err, ErrDegraded) {
+		t.Fatalf("Err after a timed-out write failed: %v", err)
+	}
+}
+
+func TestFlushStopsOnFailedWALSync(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Durability = NoSync
+	skv, err := NewShardedKV(t.TempDir(), 1, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer skv.Close()
+	db := skv.shards[0]
+	if err := skv.Set("a", []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	// The write is acknowledged but not synced; the sync on switching
+	// segments fails.
+	breakWAL(db)
+
+	if err := db.flushMemtable(); !errors.Is(err, ErrDegraded) {
+		t.Fatalf("flush over a failed sync: got %v, want ErrDegraded", err)
+	}
+	if len(db.sstables) != 0 {
+		t.Fatal("memtable flushed over a failed sync")
+	}
+}
+
+func TestDeleteShadowsFlushedValue(t *testing.T) {
+	skv, err := NewShardedKV(t.TempDir(), 1, DefaultOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer skv.Close()
+	db := skv.shards[0]
+
+	// The live value sits in an older table than the delete.
+	for _, step := range []func() error{
+		func() error { return skv.Set("gone", []byte("v")) },
+		func() error { return skv.Set("kept", []byte("__deleted__")) },
+		db.flushMemtable,
+		func() error { return skv.Delete("gone") },
+		db.flushMemtable,
+	} {
+		if err := step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if val, ok, err := skv.Get("gone"); err != nil || ok {
+		t.Fatalf("deleted key = %q, %v, %v", val, ok, err)
+	}
+	if val, ok, err := skv.Get("kept"); err != nil || !ok || string(val) != "__deleted__" {
+		t.Fatalf("kept = %q, %v, %v; want __deleted__", val, ok, err)
+	}
+}
+
+func TestAsyncWrites(t *testing.T) {
+	skv, err := NewShardedKV(t.TempDir(), 4, DefaultOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer skv.Close()
+	var futures []*WriteFuture
+	for i := range 1000 {
+		futures = append(futures, skv.SetAsync(fmt.Sprintf("k%04d", i), []byte("v")))
+	}
+	for i := range 500 {
+		futures = append(futures, skv.DeleteAsync(fmt.Sprintf("k%04d", i)))
+	}
+	for _, f := range futures {
+		if err := f.Wait(); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-f.Done():
+		default:
+			t.Fatal("Done open after Wait returned")
+		}
+	}
+	for i := range 1000 {
+		key := fmt.Sprintf("k%04d", i)
+		if _, ok, err := skv.Get(key); err != nil || ok != (i >= 500) {
+			t.Fatalf("%s present = %v, %v; want %v", key, ok, err, i >= 500)
+		}
+	}
+}
+
+// A write is only visible once it is logged, unless the store reads
+// uncommitted writes.
+func TestWriteVisibility(t *testing.T) {
+	for _, uncommitted := range []bool{false, true} {
+		t.Run(fmt.Sprintf("uncommitted=%v", uncommitted), func(t *testing.T) {
+			// The write sits in the queue until the interval ends.
+			opts := DefaultOptions()
+			opts.WALBatchSize = 1 << 20
+			opts.WALBatchInterval = 200 * time.Millisecond
+			opts.ReadUncommitted = uncommitted
+			skv, err := NewShardedKV(t.TempDir(), 1, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer skv.Close()
+
+			f := skv.SetAsync("k", []byte("v"))
+			select {
+			case <-f.Done():
+				t.Fatal("write logged before the batch interval ended")
+			default:
+			}
+			if _, ok, err := skv.Get("k"); err != nil || ok != uncommitted {
+				t.Fatalf("queued write visible = %v, %v; want %v", ok, err, uncommitted)
+			}
+			if err := f.Wait(); err != nil {
+				t.Fatal(err)
+			}
+			if _, ok, err := skv.Get("k"); err != nil || !ok {
+				t.Fatalf("logged write visible = %v, %v", ok, err)
+			}
+		})
+	}
+}
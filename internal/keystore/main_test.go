@@ -0,0 +1,14 @@
+package keystore
+
+import (
+	"log/slog"
+	"os"
+	"testing"
+
+	"github.com/Aswin-Sk/MinionDB/internal/logger"
+)
+
+func TestMain(m *testing.M) {
+	logger.InitLogger(slog.LevelError)
+	os.Exit(m.Run())
+}
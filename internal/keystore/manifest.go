@@ -0,0 +1,536 @@
+package keystore
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/Aswin-Sk/MinionDB/internal/fileformat"
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+var errBadEdit = errors.New("manifest: malformed version edit")
+
+// Every file the engine creates is named by a number drawn from a single
+// per-shard counter that is persisted in the manifest, so a name is never
+// reused even after the file it belonged to is deleted.
+type fileType int
+
+const (
+	fileTable fileType = iota
+	fileWAL
+	fileManifest
+)
+
+const currentName = "CURRENT"
+
+func tableFileName(base string, num uint64) string {
+	return filepath.Join(base, "sstables", fmt.Sprintf("%06d.sst", num))
+}
+
+func walFileName(base string, num uint64) string {
+	return filepath.Join(base, "wal", fmt.Sprintf("%06d.wal", num))
+}
+
+func manifestFileName(base string, num uint64) string {
+	return filepath.Join(base, fmt.Sprintf("MANIFEST-%06d", num))
+}
+
+// parseFileName reports the type and number of a file created by the engine.
+func parseFileName(name string) (fileType, uint64, bool) {
+	var num uint64
+	switch {
+	case strings.HasPrefix(name, "MANIFEST-"):
+		if _, err := fmt.Sscanf(name, "MANIFEST-%06d", &num); err == nil {
+			return fileManifest, num, true
+		}
+	case strings.HasSuffix(name, ".sst"):
+		if _, err := fmt.Sscanf(name, "%06d.sst", &num); err == nil {
+			return fileTable, num, true
+		}
+	case strings.HasSuffix(name, ".wal"):
+		if _, err := fmt.Sscanf(name, "%06d.wal", &num); err == nil {
+			return fileWAL, num, true
+		}
+	}
+	return 0, 0, false
+}
+
+// Before the manifest, a shard logged to wal/active.wal, or to wal/new.wal
+// once a compaction switched logs, and named its tables sst-NNNNN.sst by
+// their place in the list. Such files hold data the manifest knows nothing
+// of.
+func isLegacyFileName(name string) bool {
+	var num int
+	switch {
+	case name == "active.wal" || name == "new.wal":
+		return true
+	case strings.HasPrefix(name, "sst-"):
+		_, err := fmt.Sscanf(name, "sst-%05d.sst", &num)
+		return err == nil
+	}
+	return false
+}
+
+// legacyFiles returns the paths of the files in the shard at base that were
+// written before the manifest.
+func legacyFiles(base string) ([]string, error) {
+	var paths []string
+	for _, dir := range []string{filepath.Join(base, "sstables"), filepath.Join(base, "wal")} {
+		entries, err := os.ReadDir(dir)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, ent := range entries {
+			if isLegacyFileName(ent.Name()) {
+				paths = append(paths, filepath.Join(dir, ent.Name()))
+			}
+		}
+	}
+	return paths, nil
+}
+
+// version is the persisted state of a shard: its live SSTables, oldest
+// first, the next unused file number, the oldest WAL segment that still
+// holds writes not yet in any table, the sequence number of the last write
+// that is, and that of the last write in a deleted segment. prepared holds
+// the shard's parts of cross-shard ingests awaiting their outcome, by id.
+type version struct {
+	tables     []uint64
+	nextFile   uint64
+	logNum     uint64
+	flushedSeq uint64
+	trimmedSeq uint64
+	prepared   map[uint64]versionEdit
+}
+
+// versionEdit is one change to a version. Added tables take the place of
+// the first deleted one, so a compaction that replaces the oldest tables
+// keeps its output in the oldest slot; an edit that deletes nothing appends
+// its tables as the newest. Zero nextFile, logNum, flushedSeq or trimmedSeq
+// leaves the field as is.
+//
+// An edit with txn set is one shard's part of a cross-shard ingest. It is
+// held aside until an edit naming its id in committed applies it or one
+// naming it in aborted drops it.
+type versionEdit struct {
+	deleted    []uint64
+	added      []uint64
+	nextFile   uint64
+	logNum     uint64
+	flushedSeq uint64
+	trimmedSeq uint64
+	txn        uint64
+	committed  uint64
+	aborted    uint64
+}
+
+const (
+	tagDeleted uint64 = iota + 1
+	tagAdded
+	tagNextFile
+	tagLogNum
+	tagFlushedSeq
+	tagTrimmedSeq
+	tagTxn
+	tagCommitted
+	tagAborted
+)
+
+func (e versionEdit) apply(v *version) {
+	if e.txn != 0 {
+		if v.prepared == nil {
+			v.prepared = make(map[uint64]versionEdit)
+		}
+		v.prepared[e.txn] = e
+		return
+	}
+	if p, ok := v.prepared[e.committed]; ok {
+		delete(v.prepared, e.committed)
+		p.txn = 0
+		p.apply(v)
+	}
+	delete(v.prepared, e.aborted)
+
+	pos := len(v.tables)
+	for i, t := range v.tables {
+		if slices.Contains(e.deleted, t) {
+			pos = i
+			break
+		}
+	}
+	out := make([]uint64, 0, len(v.tables)+len(e.added))
+	for i, t := range v.tables {
+		if i == pos {
+			out = append(out, e.added...)
+		}
+		if !slices.Contains(e.deleted, t) {
+			out = append(out, t)
+		}
+	}
+	if pos == len(v.tables) {
+		out = append(out, e.added...)
+	}
+	v.tables = out
+	if e.nextFile > v.nextFile {
+		v.nextFile = e.nextFile
+	}
+	if e.logNum != 0 {
+		v.logNum = e.logNum
+	}
+	if e.flushedSeq > v.flushedSeq {
+		v.flushedSeq = e.flushedSeq
+	}
+	if e.trimmedSeq > v.trimmedSeq {
+		v.trimmedSeq = e.trimmedSeq
+	}
+}
+
+// encode writes the edit as a sequence of [tag uvarint][value uvarint]
+// pairs so that fields can be added without breaking older manifests.
+func (e versionEdit) encode() []byte {
+	var buf []byte
+	put := func(tag, val uint64) {
+		buf = binary.AppendUvarint(buf, tag)
+		buf = binary.AppendUvarint(buf, val)
+	}
+	for _, n := range e.deleted {
+		put(tagDeleted, n)
+	}
+	for _, n := range e.added {
+		put(tagAdded, n)
+	}
+	if e.nextFile != 0 {
+		put(tagNextFile, e.nextFile)
+	}
+	if e.logNum != 0 {
+		put(tagLogNum, e.logNum)
+	}
+	if e.flushedSeq != 0 {
+		put(tagFlushedSeq, e.flushedSeq)
+	}
+	if e.trimmedSeq != 0 {
+		put(tagTrimmedSeq, e.trimmedSeq)
+	}
+	if e.txn != 0 {
+		put(tagTxn, e.txn)
+	}
+	if e.committed != 0 {
+		put(tagCommitted, e.committed)
+	}
+	if e.aborted != 0 {
+		put(tagAborted, e.aborted)
+	}
+	return buf
+}
+
+func decodeVersionEdit(buf []byte) (versionEdit, error) {
+	var e versionEdit
+	for len(buf) > 0 {
+		tag, n := binary.Uvarint(buf)
+		if n <= 0 {
+			return versionEdit{}, errBadEdit
+		}
+		buf = buf[n:]
+		val, n := binary.Uvarint(buf)
+		if n <= 0 {
+			return versionEdit{}, errBadEdit
+		}
+		buf = buf[n:]
+		switch tag {
+		case tagDeleted:
+			e.deleted = append(e.deleted, val)
+		case tagAdded:
+			e.added = append(e.added, val)
+		case tagNextFile:
+			e.nextFile = val
+		case tagLogNum:
+			e.logNum = val
+		case tagFlushedSeq:
+			e.flushedSeq = val
+		case tagTrimmedSeq:
+			e.trimmedSeq = val
+		case tagTxn:
+			e.txn = val
+		case tagCommitted:
+			e.committed = val
+		case tagAborted:
+			e.aborted = val
+		default:
+			return versionEdit{}, errBadEdit
+		}
+	}
+	return e, nil
+}
+
+// manifest is an append-only log of version edits following a fileformat
+// stamp. Each record is framed as [len u32][crc32c u32][edit] and synced
+// before the edit takes effect in memory. CURRENT names the live manifest
+// file.
+type manifest struct {
+	mu   sync.Mutex
+	base string
+	f    *os.File
+	num  uint64
+	v    version
+}
+
+// openManifest replays the manifest of the shard at base. The state is then
+// written to a freshly numbered manifest, which CURRENT is switched to, so
+// the log does not grow without bound across restarts. A torn record at the
+// tail, left by a crash mid-append, is discarded.
+func openManifest(base string) (*manifest, error) {
+	var v version
+	cur, err := os.ReadFile(filepath.Join(base, currentName))
+	switch {
+	case err == nil:
+		if v, err = replayManifest(filepath.Join(base, strings.TrimSpace(string(cur)))); err != nil {
+			return nil, err
+		}
+	case !errors.Is(err, os.ErrNotExist):
+		return nil, err
+	}
+	if v.nextFile == 0 {
+		v.nextFile = 1
+	}
+
+	m := &manifest{base: base, v: v}
+	m.num = m.v.nextFile
+	m.v.nextFile++
+	if m.f, err = createManifest(base, m.num, m.v); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// createManifest writes v as the manifest numbered num of the shard at base
+// and switches CURRENT to it. The file is returned open for appending.
+func createManifest(base string, num uint64, v version) (*os.File, error) {
+	f, err := os.OpenFile(manifestFileName(base, num), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Write(manifestStamp); err != nil {
+		f.Close()
+		return nil, err
+	}
+	snapshot := versionEdit{added: v.tables, nextFile: v.nextFile, logNum: v.logNum, flushedSeq: v.flushedSeq, trimmedSeq: v.trimmedSeq}
+	if err := writeEdit(f, snapshot); err != nil {
+		f.Close()
+		return nil, err
+	}
+	for _, id := range slices.Sorted(maps.Keys(v.prepared)) {
+		if err := writeEdit(f, v.prepared[id]); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	if err := setCurrent(base, filepath.Base(f.Name())); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+func setCurrent(base, name string) error {
+	tmp := filepath.Join(base, currentName+".tmp")
+	if err := os.WriteFile(tmp, []byte(name+"\n"), 0644); err != nil {
+		return err
+	}
+	f, err := os.Open(tmp)
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	f.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(base, currentName))
+}
+
+var manifestStamp = fileformat.Append(nil, fileformat.ManifestMagic, fileformat.ManifestVersion)
+
+func replayManifest(path string) (version, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return version{}, err
+	}
+	if err := checkManifest(path, buf); err != nil {
+		return version{}, err
+	}
+	return replayEdits(path, buf[fileformat.StampSize:])
+}
+
+// checkManifest validates the stamp of the manifest held in buf. Legacy
+// manifests start straight with their first record.
+func checkManifest(path string, buf []byte) error {
+	legacy := false
+	if !fileformat.HasMagic(buf, fileformat.ManifestMagic) {
+		_, err := replayEdits(path, buf)
+		legacy = err == nil && len(buf) > 0
+	}
+	return fileformat.CheckRange(path, buf, fileformat.ManifestMagic, fileformat.OldestManifestVersion, fileformat.ManifestVersion, legacy)
+}
+
+func replayEdits(path string, buf []byte) (version, error) {
+	var v version
+	for len(buf) >= 8 {
+		n := binary.LittleEndian.Uint32(buf[0:4])
+		if uint64(len(buf)-8) < uint64(n) {
+			break
+		}
+		payload := buf[8 : 8+n]
+		if crc32.Checksum(payload, castagnoli) != binary.LittleEndian.Uint32(buf[4:8]) {
+			return v, errors.New("manifest: checksum mismatch in " + path)
+		}
+		edit, err := decodeVersionEdit(payload)
+		if err != nil {
+			return v, err
+		}
+		edit.apply(&v)
+		buf = buf[8+n:]
+	}
+	return v, nil
+}
+
+// upgradeManifest stamps a legacy manifest at path. It reports whether the
+// file needed upgrading.
+func upgradeManifest(path string) (bool, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	if err := checkManifest(path, buf); !errors.Is(err, fileformat.ErrLegacyFormat) {
+		return false, err
+	}
+	return true, fileformat.Rewrite(path, manifestStamp, nil)
+}
+
+func (m *manifest) write(e versionEdit) error {
+	return writeEdit(m.f, e)
+}
+
+func writeEdit(f *os.File, e versionEdit) error {
+	payload := e.encode()
+	rec := make([]byte, 8, 8+len(payload))
+	binary.LittleEndian.PutUint32(rec[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(rec[4:8], crc32.Checksum(payload, castagnoli))
+	rec = append(rec, payload...)
+	if _, err := f.Write(rec); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// logAndApply persists e and then applies it to the in-memory version.
+func (m *manifest) logAndApply(e versionEdit) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.write(e); err != nil {
+		return err
+	}
+	e.apply(&m.v)
+	return nil
+}
+
+// newFileNum allocates a file number. The new high-water mark is persisted
+// before the number is handed out, so a crash can never lead to reuse.
+func (m *manifest) newFileNum() (uint64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	num := m.v.nextFile
+	e := versionEdit{nextFile: num + 1}
+	if err := m.write(e); err != nil {
+		return 0, err
+	}
+	e.apply(&m.v)
+	return num, nil
+}
+
+// newWALPath allocates the path of a new WAL segment.
+func (m *manifest) newWALPath() (string, error) {
+	num, err := m.newFileNum()
+	if err != nil {
+		return "", err
+	}
+	return walFileName(m.base, num), nil
+}
+
+func (m *manifest) current() version {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	v := m.v
+	v.tables = slices.Clone(m.v.tables)
+	v.prepared = maps.Clone(m.v.prepared)
+	return v
+}
+
+// resolve applies the prepared ingests whose ids are in committed and drops
+// the others.
+func (m *manifest) resolve(committed map[uint64]bool) error {
+	for _, id := range slices.Sorted(maps.Keys(m.current().prepared)) {
+		e := versionEdit{aborted: id}
+		if committed[id] {
+			e = versionEdit{committed: id}
+		}
+		if err := m.logAndApply(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeObsoleteFiles deletes every engine-created file that the current
+// version no longer references: tables dropped by compaction and superseded
+// manifests. Tables of prepared ingests are kept. WAL segments are left to
+// trimWAL, which honours the retention period.
+func (m *manifest) removeObsoleteFiles() error {
+	v := m.current()
+	live := v.tables
+	for _, e := range v.prepared {
+		live = append(live, e.added...)
+	}
+	var errs []error
+	for _, dir := range []string{m.base, filepath.Join(m.base, "sstables")} {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for _, ent := range entries {
+			typ, num, ok := parseFileName(ent.Name())
+			if !ok {
+				continue
+			}
+			var keep bool
+			switch typ {
+			case fileTable:
+				keep = slices.Contains(live, num)
+			case fileManifest:
+				keep = num == m.num
+			}
+			if !keep {
+				if err := os.Remove(filepath.Join(dir, ent.Name())); err != nil {
+					errs = append(errs, err)
+				}
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (m *manifest) close() error {
+	return m.f.Close()
+}
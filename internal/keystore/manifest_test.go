@@ -0,0 +1,198 @@
+package keystore
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestVersionEditApply(t *testing.T) {
+	var v version
+	for _, e := range []versionEdit{
+		{added: []uint64{1}},
+		{added: []uint64{2}},
+		{added: []uint64{3}},
+		// A compaction of the two oldest tables keeps the oldest slot.
+		{deleted: []uint64{1, 2}, added: []uint64{4}},
+		{added: []uint64{5}},
+	} {
+		e.apply(&v)
+	}
+	if want := []uint64{4, 3, 5}; !slices.Equal(v.tables, want) {
+		t.Fatalf("tables %v, want %v", v.tables, want)
+	}
+}
+
+func TestVersionEditEncoding(t *testing.T) {
+	e := versionEdit{deleted: []uint64{1, 2}, added: []uint64{3}, nextFile: 4, logNum: 5, flushedSeq: 6, trimmedSeq: 7}
+	got, err := decodeVersionEdit(e.encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, e) {
+		t.Fatalf("decoded %+v, want %+v", got, e)
+	}
+	if _, err := decodeVersionEdit([]byte{99, 1}); err == nil {
+		t.Fatal("decoded an edit with an unknown tag")
+	}
+}
+
+func TestManifestReplay(t *testing.T) {
+	base := t.TempDir()
+	m, err := openManifest(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range []versionEdit{
+		{added: []uint64{10}},
+		{added: []uint64{11}, flushedSeq: 7},
+		{deleted: []uint64{10, 11}, added: []uint64{12}},
+	} {
+		if err := m.logAndApply(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := m.current()
+	m.close()
+	// A crash mid-append leaves a torn record.
+	f, err := os.OpenFile(m.f.Name(), os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{40, 0, 0, 0, 1, 2})
+	f.Close()
+
+	m, err = openManifest(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.close()
+	got := m.current()
+	if !slices.Equal(got.tables, want.tables) || got.flushedSeq != want.flushedSeq {
+		t.Fatalf("replayed %+v, want %+v", got, want)
+	}
+	cur, err := os.ReadFile(filepath.Join(base, currentName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := strings.TrimSpace(string(cur)); name != filepath.Base(m.f.Name()) {
+		t.Fatalf("CURRENT names %s, want %s", name, filepath.Base(m.f.Name()))
+	}
+}
+
+func TestTablesSurviveRestart(t *testing.T) {
+	dir := t.TempDir()
+	skv, err := NewShardedKV(dir, 1, DefaultOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := skv.shards[0]
+	for round := range 3 {
+		for i := range 10 {
+			if err := skv.Set(fmt.Sprintf("k%d", i), []byte(fmt.Sprint(round))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := db.flushMemtable(); err != nil {
+			t.Fatal(err)
+		}
+		if round == 1 {
+			if err := db.CompactSSTables(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := skv.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	skv, err = NewShardedKV(dir, 1, DefaultOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer skv.Close()
+	if n := len(skv.shards[0].sstables); n != 2 {
+		t.Fatalf("reopened with %d tables, want 2", n)
+	}
+	for i := range 10 {
+		if val, ok, err := skv.Get(fmt.Sprintf("k%d", i)); err != nil || !ok || string(val) != "2" {
+			t.Fatalf("k%d = %q, %v, %v; want 2", i, val, ok, err)
+		}
+	}
+}
+
+func TestFileNumbersNotReused(t *testing.T) {
+	base := t.TempDir()
+	seen := make(map[uint64]bool)
+	for range 3 {
+		m, err := openManifest(base)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nums := []uint64{m.num}
+		for range 3 {
+			num, err := m.newFileNum()
+			if err != nil {
+				t.Fatal(err)
+			}
+			nums = append(nums, num)
+		}
+		// As a crash would, without closing cleanly.
+		m.f.Close()
+		for _, num := range nums {
+			if seen[num] {
+				t.Fatalf("file number %d handed out twice", num)
+			}
+			seen[num] = true
+		}
+	}
+}
+
+func TestOpenRemovesOrphanFiles(t *testing.T) {
+	dir := t.TempDir()
+	skv, err := NewShardedKV(dir, 1, DefaultOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := skv.shards[0]
+	if err := skv.Set("k", []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.flushMemtable(); err != nil {
+		t.Fatal(err)
+	}
+	live := db.sstables[0].Path
+	base := db.manifest.base
+	// A table written by a flush that crashed before its edit, and a
+	// manifest that CURRENT no longer names.
+	orphans := []string{tableFileName(base, 900), manifestFileName(base, 901)}
+	for _, path := range orphans {
+		if err := os.WriteFile(path, []byte("junk"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := skv.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	skv, err = NewShardedKV(dir, 1, DefaultOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer skv.Close()
+	for _, path := range orphans {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Fatalf("orphan %s survived open: %v", path, err)
+		}
+	}
+	if _, err := os.Stat(live); err != nil {
+		t.Fatalf("live table removed: %v", err)
+	}
+	if val, ok, err := skv.Get("k"); err != nil || !ok || string(val) != "v" {
+		t.Fatalf("k = %q, %v, %v; want v", val, ok, err)
+	}
+}
@@ -0,0 +1,265 @@
+package keystore
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/Aswin-Sk/MinionDB/internal/SSTables"
+)
+
+// ErrCheckpointTooNew is returned by Restore when the checkpoint's tables
+// already hold writes from after the restore point.
+var ErrCheckpointTooNew = errors.New("checkpoint is newer than the restore point")
+
+// RestorePoint is where Restore stops: after the record numbered Seq or, if
+// Seq is zero, after the last record written at or before Time.
+type RestorePoint struct {
+	Seq  uint64
+	Time time.Time
+}
+
+// restoreShard is a shard being restored and the segments replayed into it,
+// oldest first.
+type restoreShard struct {
+	base     string
+	man      *manifest
+	segments []string
+}
+
+// Restore builds a store at target, which must not exist, from the
+// checkpoint at checkpoint and the segments archived under archive. Every
+// write up to the point is replayed on top of the checkpoint with ReplayWAL
+// and the result is written out as tables. A cross-shard batch is restored
+// whole if it committed by the point, that is if any shard logged its commit
+// record by then, and dropped otherwise. The archive is only read, so it may
+// sit on read-only media.
+//
+// The restored store numbers its writes on from the point, so it should
+// archive to a new directory rather than to archive.
+func Restore(checkpoint, archive, target string, to RestorePoint, opts Options) (err error) {
+	if _, err := os.Stat(target); err == nil {
+		return fmt.Errorf("restore: %s already exists", target)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	srcs, err := filepath.Glob(filepath.Join(checkpoint, "shard-*"))
+	if err != nil {
+		return err
+	}
+	if len(srcs) == 0 {
+		return fmt.Errorf("restore: %s holds no shards", checkpoint)
+	}
+	if err := copyTree(checkpoint, target); err != nil {
+		return err
+	}
+
+	var shards []*restoreShard
+	defer func() {
+		for _, s := range shards {
+			err = errors.Join(err, s.man.close())
+		}
+	}()
+	for _, src := range srcs {
+		s := &restoreShard{base: filepath.Join(target, filepath.Base(src))}
+		if s.man, err = openManifest(s.base); err != nil {
+			return err
+		}
+		shards = append(shards, s)
+		if s.segments, err = restoreSegments(s.base, filepath.Join(archive, filepath.Base(src)), s.man.current().logNum); err != nil {
+			return err
+		}
+	}
+
+	committed, err := readTxnLog(target, opts.WALRecovery)
+	if err != nil {
+		return err
+	}
+	until, firstCommit, err := scanArchive(target, archive, to)
+	if err != nil {
+		return err
+	}
+	if committed == nil {
+		committed = make(map[uint64]bool)
+	}
+	for id, seq := range firstCommit {
+		if seq <= until {
+			committed[id] = true
+		}
+	}
+	for _, s := range shards {
+		if s.man.current().flushedSeq > until {
+			return fmt.Errorf("%s: %w", s.base, ErrCheckpointTooNew)
+		}
+	}
+	for _, s := range shards {
+		if err := s.restore(until, committed, opts); err != nil {
+			return err
+		}
+	}
+	// Every batch has been resolved.
+	txns, err := createTxnLog(target)
+	if err != nil {
+		return err
+	}
+	return txns.close()
+}
+
+// restore replays the shard's segments up to until, writes the result out
+// as a table and drops the segments.
+func (s *restoreShard) restore(until uint64, committed map[uint64]bool, opts Options) error {
+	v := s.man.current()
+	r := &walReplay{
+		mem:     make(map[string]SSTables.Entry),
+		pending: make(map[uint64][]batchOp),
+		flushed: v.flushedSeq,
+		until:   until,
+		lastSeq: v.flushedSeq,
+	}
+	for _, path := range s.segments {
+		if err := ReplayWAL(path, opts.WALRecovery, r); err != nil {
+			return err
+		}
+	}
+	// No write to the shard comes between a prepared record and its commit
+	// record, so a batch committed after the point on this shard goes last.
+	for _, id := range slices.Sorted(maps.Keys(r.pending)) {
+		if committed[id] {
+			applyOps(r.mem, r.pending[id])
+		}
+	}
+
+	var added []uint64
+	if len(r.mem) > 0 {
+		num, err := s.man.newFileNum()
+		if err != nil {
+			return err
+		}
+		if err := writeTableFile(tableFileName(s.base, num), sortedRecords(r.mem), v.flushedSeq+1, r.lastSeq, opts.Table); err != nil {
+			return err
+		}
+		added = []uint64{num}
+	}
+	logNum, err := s.man.newFileNum()
+	if err != nil {
+		return err
+	}
+	if err := s.man.logAndApply(versionEdit{added: added, logNum: logNum, flushedSeq: r.lastSeq}); err != nil {
+		return err
+	}
+	nums, err := liveWALs(s.base, 0)
+	if err != nil {
+		return err
+	}
+	for _, num := range nums {
+		if err := os.Remove(walFileName(s.base, num)); err != nil {
+			return err
+		}
+	}
+	return s.man.removeObsoleteFiles()
+}
+
+// restoreSegments copies the segments numbered logNum or later from the
+// shard's archive directory into the shard at base, as the checkpoint may
+// hold only the start of a segment, and returns the shard's segments from
+// logNum on, oldest first. Replay may truncate a torn tail, so it works on
+// the copies and the archive is only ever read.
+func restoreSegments(base, archive string, logNum uint64) ([]string, error) {
+	entries, err := os.ReadDir(archive)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, ent := range entries {
+		if typ, num, ok := parseFileName(ent.Name()); ok && typ == fileWAL && num >= logNum {
+			if err := copyFile(filepath.Join(archive, ent.Name()), walFileName(base, num)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	nums, err := liveWALs(base, logNum)
+	if err != nil {
+		return nil, err
+	}
+	segments := make([]string, len(nums))
+	for i, num := range nums {
+		segments[i] = walFileName(base, num)
+	}
+	return segments, nil
+}
+
+// scanArchive reads every segment of the restored shards under target and
+// under archive. It returns the number of the last record to restore and,
+// for each cross-shard batch, the number of the first commit record any
+// shard logged for it.
+func scanArchive(target, archive string, to RestorePoint) (uint64, map[uint64]uint64, error) {
+	// A time before every record leaves until at zero, which restores
+	// nothing past what the checkpoint's tables hold.
+	until := to.Seq
+	if until == 0 && to.Time.IsZero() {
+		until = math.MaxUint64
+	}
+	var paths []string
+	for _, pattern := range []string{filepath.Join(target, "shard-*", "wal", "*.wal"), filepath.Join(archive, "shard-*", "*.wal")} {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return 0, nil, err
+		}
+		paths = append(paths, matches...)
+	}
+	firstCommit := make(map[uint64]uint64)
+	for _, path := range paths {
+		r, err := openWALReader(path)
+		if err != nil {
+			return 0, nil, err
+		}
+		for r.next() {
+			rec := r.rec
+			if rec.seq == 0 {
+				continue
+			}
+			if to.Seq == 0 && rec.time <= to.Time.UnixNano() {
+				until = max(until, rec.seq)
+			}
+			if rec.ops[0].t == opCommit {
+				id := txnID(rec.ops[0].key)
+				if seq, ok := firstCommit[id]; !ok || rec.seq < seq {
+					firstCommit[id] = rec.seq
+				}
+			}
+		}
+		r.close()
+		if r.err != nil {
+			return 0, nil, r.err
+		}
+	}
+	return until, firstCommit, nil
+}
+
+// copyTree copies the store at src to dst, linking its tables.
+func copyTree(src, dst string) error {
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		out := filepath.Join(dst, rel)
+		switch {
+		case d.IsDir():
+			return os.MkdirAll(out, 0755)
+		case strings.HasSuffix(d.Name(), ".sst"):
+			return linkFile(path, out)
+		default:
+			return copyFile(path, out)
+		}
+	})
+}
@@ -0,0 +1,143 @@
+package keystore
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRestoreToPoint(t *testing.T) {
+	dir, archive := t.TempDir(), t.TempDir()
+	ckpt := filepath.Join(t.TempDir(), "checkpoint")
+	opts := DefaultOptions()
+	opts.WALArchiveDir = archive
+	skv, err := NewShardedKV(dir, 2, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := skv.Checkpoint(ckpt); err != nil {
+		t.Fatal(err)
+	}
+	before := time.Now()
+	time.Sleep(2 * time.Millisecond)
+	for _, key := range []string{"a", "b"} {
+		if err := skv.Set(key, []byte("1")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	seq := skv.seq.Load()
+	time.Sleep(2 * time.Millisecond)
+	at := time.Now()
+	time.Sleep(2 * time.Millisecond)
+	if err := skv.Set("a", []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := skv.Delete("b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := skv.Set("c", []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := skv.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	first := map[string]string{"a": "1", "b": "1"}
+	tests := []struct {
+		name string
+		to   RestorePoint
+		want map[string]string
+	}{
+		{"seq", RestorePoint{Seq: seq}, first},
+		{"time", RestorePoint{Time: at}, first},
+		{"time before every write", RestorePoint{Time: before}, map[string]string{}},
+		{"latest", RestorePoint{}, map[string]string{"a": "2", "c": "2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := filepath.Join(t.TempDir(), "restored")
+			if err := Restore(ckpt, archive, target, tt.to, DefaultOptions()); err != nil {
+				t.Fatal(err)
+			}
+			skv, err := NewShardedKV(target, 2, DefaultOptions())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer skv.Close()
+			for _, key := range []string{"a", "b", "c"} {
+				val, ok, err := skv.Get(key)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if w, live := tt.want[key]; ok != live || string(val) != w {
+					t.Errorf("%s = %q, %v; want %q, %v", key, val, ok, w, live)
+				}
+			}
+		})
+	}
+}
+
+func TestRestoreLeavesArchiveUntouched(t *testing.T) {
+	dir, archive := t.TempDir(), t.TempDir()
+	ckpt := filepath.Join(t.TempDir(), "checkpoint")
+	opts := DefaultOptions()
+	opts.WALArchiveDir = archive
+	skv, err := NewShardedKV(dir, 1, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := skv.Checkpoint(ckpt); err != nil {
+		t.Fatal(err)
+	}
+	if err := skv.Set("a", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := skv.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	segments, err := filepath.Glob(filepath.Join(archive, "shard-0", "*.wal"))
+	if err != nil || len(segments) == 0 {
+		t.Fatalf("archived segments: %v, %v", segments, err)
+	}
+	// A torn record at the end of the newest segment.
+	last := segments[len(segments)-1]
+	f, err := os.OpenFile(last, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte{9, 0, 0}); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	want := make(map[string][]byte)
+	for _, path := range segments {
+		if want[path], err = os.ReadFile(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	target := filepath.Join(t.TempDir(), "restored")
+	if err := Restore(ckpt, archive, target, RestorePoint{}, DefaultOptions()); err != nil {
+		t.Fatal(err)
+	}
+	for path, b := range want {
+		got, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, b) {
+			t.Errorf("Restore modified archived segment %s", path)
+		}
+	}
+	restored, err := NewShardedKV(target, 1, DefaultOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+	if val, ok, err := restored.Get("a"); err != nil || !ok || string(val) != "1" {
+		t.Fatalf("a = %q, %v, %v; want 1", val, ok, err)
+	}
+}
@@ -1,63 +1,167 @@
 package keystore
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"hash/fnv"
+	"os"
 	"path/filepath"
+	"sync"
+	"sync/atomic"
+
+	"github.com/Aswin-Sk/MinionDB/internal/SSTables"
 )
 
 type ShardedKV struct {
 	shards        []*MiniKV
 	n             int
 	baseDirectory string
+	tables        *SSTables.TableCache
+	blocks        *SSTables.BlockCache
+	txns          *txnLog
+	health        health
+	events        *eventHub
+	// ckptMu is held shared by cross-shard batches and exclusively by
+	// Checkpoint.
+	ckptMu sync.RWMutex
+	// seq hands out the sequence numbers of WAL records in every shard.
+	seq atomic.Uint64
 }
 
-func NewShardedKV(path string, shards int) (*ShardedKV, error) {
+func NewShardedKV(path string, shards int, opts Options) (*ShardedKV, error) {
 	skv := &ShardedKV{
 		n:             shards,
 		baseDirectory: path,
+		events:        newEventHub(),
+	}
+	if opts.BlockCacheSize > 0 {
+		skv.blocks = SSTables.NewBlockCache(opts.BlockCacheSize)
+	}
+	skv.tables = SSTables.NewTableCache(opts.MaxOpenFiles, opts.Mmap, skv.blocks)
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return nil, err
 	}
+	committed, err := readTxnLog(path, opts.WALRecovery)
+	if err != nil {
+		return nil, err
+	}
+	var outcomes [][]batchOp
 	for i := range shards {
-		kv, err := open(filepath.Join(path, fmt.Sprintf("shard-%d", i)))
+		log := &shardLog{shard: i, seq: &skv.seq, fail: skv.health.fail, events: skv.events}
+		kv, resolved, err := open(filepath.Join(path, fmt.Sprintf("shard-%d", i)), opts, skv.tables, &skv.health, log, committed)
 		if err != nil {
 			return nil, err
 		}
 		skv.shards = append(skv.shards, kv)
+		outcomes = append(outcomes, resolved)
+	}
+	// New records can only be numbered once every shard has been replayed.
+	skv.events.start(skv.seq.Load() + 1)
+	for i, kv := range skv.shards {
+		if err := kv.logOutcomes(outcomes[i]); err != nil {
+			return nil, err
+		}
+	}
+	// Every shard has logged the outcome of its prepared batches, so the
+	// commit records are no longer needed.
+	if skv.txns, err = createTxnLog(path); err != nil {
+		return nil, err
 	}
+	skv.txns.lastID.Store(skv.seq.Load())
 	return skv, nil
 }
 
-func (skv *ShardedKV) getShard(key string) *MiniKV {
+func (skv *ShardedKV) shardIndex(key string) int {
 	h := fnv.New32a()
 	h.Write([]byte(key))
-	return skv.shards[int(h.Sum32())%skv.n]
+	return int(h.Sum32()) % skv.n
+}
+
+func (skv *ShardedKV) getShard(key string) *MiniKV {
+	return skv.shards[skv.shardIndex(key)]
 }
 
 func (skv *ShardedKV) Set(key string, val []byte) error {
 	return skv.getShard(key).Set(key, val)
 }
 
-func (skv *ShardedKV) Get(key string) ([]byte, bool) {
+func (skv *ShardedKV) Get(key string) ([]byte, bool, error) {
 	return skv.getShard(key).Get(key)
 }
 
+func (skv *ShardedKV) GetWithOptions(key string, ro SSTables.ReadOptions) ([]byte, bool, error) {
+	return skv.getShard(key).GetWithOptions(key, ro)
+}
+
+// CacheStats reports the block cache's counters. All are zero when the
+// cache is disabled.
+func (skv *ShardedKV) CacheStats() SSTables.CacheStats {
+	if skv.blocks == nil {
+		return SSTables.CacheStats{}
+	}
+	return skv.blocks.Stats()
+}
+
 func (skv *ShardedKV) Delete(key string) error {
 	return skv.getShard(key).Delete(key)
 }
 
+func (skv *ShardedKV) SetWithOptions(key string, val []byte, wo WriteOptions) error {
+	return skv.getShard(key).SetWithOptions(key, val, wo)
+}
+
+func (skv *ShardedKV) DeleteWithOptions(key string, wo WriteOptions) error {
+	return skv.getShard(key).DeleteWithOptions(key, wo)
+}
+
+// SetAsync and DeleteAsync return once the write is queued for the WAL,
+// blocking only while the shard's queue is full, so that many writes can be
+// in flight from one goroutine. The write becomes visible once it is logged,
+// when the returned future is done, or under ReadUncommitted as soon as it
+// is queued.
+func (skv *ShardedKV) SetAsync(key string, val []byte) *WriteFuture {
+	return skv.getShard(key).SetAsync(key, val)
+}
+
+func (skv *ShardedKV) DeleteAsync(key string) *WriteFuture {
+	return skv.getShard(key).DeleteAsync(key)
+}
+
+// SetCtx, DeleteCtx and GetCtx honour ctx's cancellation and deadline, and
+// the writes fail with ErrBusy rather than wait for a full WAL queue.
+func (skv *ShardedKV) SetCtx(ctx context.Context, key string, val []byte) error {
+	return skv.getShard(key).SetCtx(ctx, key, val)
+}
+
+func (skv *ShardedKV) DeleteCtx(ctx context.Context, key string) error {
+	return skv.getShard(key).DeleteCtx(ctx, key)
+}
+
+func (skv *ShardedKV) GetCtx(ctx context.Context, key string) ([]byte, bool, error) {
+	return skv.getShard(key).GetCtx(ctx, key)
+}
+
+// Err returns the DegradedError that made the store read-only, or nil.
+func (skv *ShardedKV) Err() error {
+	return skv.health.check()
+}
+
+// Close closes every shard, the transaction log and the table cache, even
+// if some fail to close, and returns all their errors.
 func (skv *ShardedKV) Close() error {
+	skv.events.close()
+	var errs []error
 	for _, s := range skv.shards {
-		err := s.Close()
-		if err != nil {
-			return err
-		}
+		errs = append(errs, s.Close())
 	}
-	return nil
+	errs = append(errs, skv.txns.close(), skv.tables.Close())
+	return errors.Join(errs...)
 }
 
-func (skv *ShardedKV) Compact(basePath string) error {
-	for i, shard := range skv.shards {
-		if err := shard.Compact(filepath.Join(basePath, fmt.Sprintf("shard-%d.wal", i))); err != nil {
+func (skv *ShardedKV) Compact() error {
+	for _, shard := range skv.shards {
+		if err := shard.Compact(); err != nil {
 			return err
 		}
 	}
@@ -0,0 +1,154 @@
+package keystore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+
+	"github.com/Aswin-Sk/MinionDB/internal/SSTables"
+	"github.com/Aswin-Sk/MinionDB/internal/fileformat"
+	"github.com/Aswin-Sk/MinionDB/internal/logger"
+)
+
+const txnLogName = "TXNLOG"
+
+// txnLog is the coordinator of cross-shard batches and ingests. Each shard
+// first logs its part of a batch as a prepared WAL record, or of an ingest
+// as a prepared manifest edit; appending the id here is the point at which
+// the batch or ingest commits. Records are framed like WAL records, with the
+// id as payload.
+//
+// Open resolves every prepared batch and ingest and records the outcome in
+// the shard WALs and manifests, after which the log is emptied. Batch ids
+// still need to be unique across runs for Restore, which matches up the
+// parts of a batch in archived segments, so each run starts them from the
+// sequence number it opened at: every batch that reaches a WAL takes at
+// least one sequence number, so no earlier id can be that high. Ingests
+// take no sequence number, so their ids, which only need to be unique until
+// the next open, have the top bit set and a count of their own.
+type txnLog struct {
+	mu         sync.Mutex
+	f          *os.File
+	lastID     atomic.Uint64
+	lastIngest atomic.Uint64
+}
+
+func txnLogFileName(base string) string {
+	return filepath.Join(base, txnLogName)
+}
+
+// readTxnLog returns the ids of the batches committed in the log under base.
+// A missing log has none.
+func readTxnLog(base string, mode WALRecoveryMode) (map[uint64]bool, error) {
+	path := txnLogFileName(base)
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	committed := make(map[uint64]bool)
+	if st.Size() < fileformat.StampSize {
+		// Torn while being created; nothing can have committed.
+		return committed, nil
+	}
+	r := bufio.NewReader(f)
+	var hdr [fileformat.StampSize]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	if err := fileformat.Check(path, hdr[:], fileformat.TxnLogMagic, fileformat.TxnLogVersion, false); err != nil {
+		return nil, err
+	}
+	off := int64(fileformat.StampSize)
+	for {
+		payload, span, err := readWALRecord(r, st.Size()-off)
+		if err == io.EOF {
+			break
+		}
+		if err == nil && len(payload) != 8 {
+			err = errBadRecord
+		}
+		if err == nil {
+			committed[binary.LittleEndian.Uint64(payload)] = true
+			off += span
+			continue
+		}
+		if span == 0 {
+			return nil, err
+		}
+		// A lost commit record aborts its batch, which keeps it atomic, so
+		// only strict recovery refuses to carry on.
+		next, tail, rerr := afterDamage(f, off, span, st.Size(), func(p []byte) bool { return len(p) == 8 })
+		if rerr != nil {
+			return nil, rerr
+		}
+		if mode == WALStrict || (mode == WALTolerateTail && !tail) {
+			return nil, &SSTables.CorruptionError{Path: path, Offset: off, Reason: err.Error()}
+		}
+		logger.Logger.Warn("dropping damaged transaction log record", "path", path, "offset", off, "error", err)
+		if tail {
+			break
+		}
+		off = next
+		if _, err := f.Seek(off, io.SeekStart); err != nil {
+			return nil, err
+		}
+		r.Reset(f)
+	}
+	return committed, nil
+}
+
+// createTxnLog replaces the log under base with an empty one and opens it
+// for appending.
+func createTxnLog(base string) (*txnLog, error) {
+	path := txnLogFileName(base)
+	stamp := fileformat.Append(nil, fileformat.TxnLogMagic, fileformat.TxnLogVersion)
+	err := fileformat.Replace(path, func(w io.Writer) error {
+		_, err := w.Write(stamp)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &txnLog{f: f}, nil
+}
+
+func (l *txnLog) nextID() uint64 {
+	return l.lastID.Add(1)
+}
+
+func (l *txnLog) nextIngestID() uint64 {
+	return 1<<63 | l.lastIngest.Add(1)
+}
+
+// commit durably records that the batch id committed.
+func (l *txnLog) commit(id uint64) error {
+	buf := make([]byte, walRecordHeaderSize, walRecordHeaderSize+8)
+	buf = frameRecord(binary.LittleEndian.AppendUint64(buf, id), 0)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.f.Write(buf); err != nil {
+		return err
+	}
+	return l.f.Sync()
+}
+
+func (l *txnLog) close() error {
+	return l.f.Close()
+}
@@ -0,0 +1,165 @@
+package keystore
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Aswin-Sk/MinionDB/internal/SSTables"
+	"github.com/Aswin-Sk/MinionDB/internal/fileformat"
+)
+
+// Upgrade rewrites the legacy unstamped tables, WALs and manifests of every
+// shard under base into the current format, moving files written before the
+// manifest into it, and returns the paths it rewrote. Files already in the
+// current format are left alone, so an interrupted upgrade can simply be
+// run again. The store must not be open.
+func Upgrade(base string) ([]string, error) {
+	shards, err := filepath.Glob(filepath.Join(base, "shard-*"))
+	if err != nil {
+		return nil, err
+	}
+	var upgraded []string
+	for _, shard := range shards {
+		written, err := upgradeLegacyShard(shard)
+		upgraded = append(upgraded, written...)
+		if err != nil {
+			return upgraded, err
+		}
+		for _, dir := range []string{shard, filepath.Join(shard, "sstables")} {
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				return upgraded, err
+			}
+			for _, ent := range entries {
+				typ, _, ok := parseFileName(ent.Name())
+				if !ok {
+					continue
+				}
+				path := filepath.Join(dir, ent.Name())
+				var changed bool
+				switch typ {
+				case fileTable:
+					changed, err = SSTables.UpgradeTable(path)
+				case fileManifest:
+					changed, err = upgradeManifest(path)
+				}
+				if err != nil {
+					return upgraded, err
+				}
+				if changed {
+					upgraded = append(upgraded, path)
+				}
+			}
+		}
+	}
+	return upgraded, nil
+}
+
+// upgradeLegacyShard moves the files of the shard at base that predate the
+// manifest into it and returns the paths of the files it wrote in their
+// place. Each table becomes a numbered table, rewritten through a Writer if
+// it predates blocks, and the WALs become a single numbered segment, which
+// recovery replays on top of the tables. One manifest edit lists them all;
+// only then are the legacy files removed, so an interrupted upgrade simply
+// converts them again.
+func upgradeLegacyShard(base string) ([]string, error) {
+	legacy, err := legacyFiles(base)
+	if err != nil || len(legacy) == 0 {
+		return nil, err
+	}
+	man, err := openManifest(base)
+	if err != nil {
+		return nil, err
+	}
+	defer man.close()
+
+	// Names sort oldest first: tables by number, active.wal before new.wal.
+	var edit versionEdit
+	var written, wals []string
+	for _, path := range legacy {
+		if strings.HasSuffix(path, ".wal") {
+			wals = append(wals, path)
+			continue
+		}
+		num, err := man.newFileNum()
+		if err != nil {
+			return written, err
+		}
+		dst := tableFileName(base, num)
+		if err := upgradeLegacyTable(path, dst); err != nil {
+			return written, err
+		}
+		edit.added = append(edit.added, num)
+		written = append(written, dst)
+	}
+	if len(wals) > 0 {
+		num, err := man.newFileNum()
+		if err != nil {
+			return written, err
+		}
+		dst := walFileName(base, num)
+		if err := convertLegacyWALs(wals, dst); err != nil {
+			return written, err
+		}
+		edit.logNum = num
+		written = append(written, dst)
+	}
+	if err := man.logAndApply(edit); err != nil {
+		return written, err
+	}
+	for _, path := range legacy {
+		if err := os.Remove(path); err != nil {
+			return written, err
+		}
+	}
+	return written, man.removeObsoleteFiles()
+}
+
+// upgradeLegacyTable writes the legacy table at src to dst in the current
+// format. Block tables only lack a stamp; raw tables are rewritten.
+func upgradeLegacyTable(src, dst string) error {
+	_, err := SSTables.UpgradeTable(src)
+	if err == nil {
+		return linkFile(src, dst)
+	}
+	if !errors.Is(err, fileformat.ErrBadMagic) {
+		return err
+	}
+	w, err := SSTables.NewWriter(dst, SSTables.DefaultOptions())
+	if err != nil {
+		return err
+	}
+	if err := SSTables.ScanRawTable(src, w.Add); err != nil {
+		w.Abort()
+		return err
+	}
+	return w.Finish()
+}
+
+// convertLegacyWALs writes the records of the unframed logs at paths, in
+// order, to a single segment at dst. A record cut short by a crash at the
+// end of a log is dropped.
+func convertLegacyWALs(paths []string, dst string) error {
+	out := append([]byte(nil), walStamp...)
+	for _, path := range paths {
+		records, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		for len(records) > 0 {
+			op, key, val, rest, ok := decodeLegacyWALRecord(records)
+			if !ok {
+				break
+			}
+			out = appendWALRecord(out, 0, 0, []batchOp{{t: op, key: key, val: val}})
+			records = rest
+		}
+	}
+	return fileformat.Replace(dst, func(w io.Writer) error {
+		_, err := w.Write(out)
+		return err
+	})
+}
@@ -0,0 +1,115 @@
+package keystore
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Aswin-Sk/MinionDB/internal/fileformat"
+)
+
+// rawTable encodes records the way tables were written before they had
+// blocks, with deletes as the value "__deleted__".
+func rawTable(kvs ...string) []byte {
+	var b []byte
+	for i := 0; i < len(kvs); i += 2 {
+		b = binary.LittleEndian.AppendUint32(b, uint32(len(kvs[i])))
+		b = binary.LittleEndian.AppendUint32(b, uint32(len(kvs[i+1])))
+		b = append(b, kvs[i]...)
+		b = append(b, kvs[i+1]...)
+	}
+	return b
+}
+
+// rawWAL encodes sets, and deletes where the value is nil, the way the WAL
+// was written before records were framed.
+func rawWAL(ops ...batchOp) []byte {
+	var b []byte
+	for _, op := range ops {
+		b = append(b, byte(op.t))
+		b = binary.LittleEndian.AppendUint32(b, uint32(len(op.key)))
+		if op.t == opSet {
+			b = binary.LittleEndian.AppendUint32(b, uint32(len(op.val)))
+		}
+		b = append(b, op.key...)
+		b = append(b, op.val...)
+	}
+	return b
+}
+
+// writeBaselineShard lays out a shard as it was before the manifest.
+func writeBaselineShard(t *testing.T, base string) {
+	t.Helper()
+	files := map[string][]byte{
+		"sstables/sst-00001.sst": rawTable("a", "1", "b", "2", "c", "3"),
+		"sstables/sst-00002.sst": rawTable("a", "10", "c", "__deleted__"),
+		"wal/active.wal": rawWAL(
+			batchOp{t: opSet, key: "d", val: []byte("4")},
+			batchOp{t: opDel, key: "b"},
+		),
+		// Cut short by a crash.
+		"wal/new.wal": append(rawWAL(batchOp{t: opSet, key: "e", val: []byte("5")}), byte(opSet), 1),
+	}
+	for name, data := range files {
+		path := filepath.Join(base, "shard-0", name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestOpenRefusesBaselineShard(t *testing.T) {
+	dir := t.TempDir()
+	writeBaselineShard(t, dir)
+	skv, err := NewShardedKV(dir, 1, DefaultOptions())
+	if err == nil {
+		skv.Close()
+	}
+	if !errors.Is(err, fileformat.ErrLegacyFormat) {
+		t.Fatalf("got %v, want ErrLegacyFormat", err)
+	}
+}
+
+func TestUpgradeBaselineShard(t *testing.T) {
+	dir := t.TempDir()
+	writeBaselineShard(t, dir)
+	upgraded, err := Upgrade(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Two tables and one segment.
+	if len(upgraded) != 3 {
+		t.Fatalf("upgraded %v, want three files", upgraded)
+	}
+	legacy, err := legacyFiles(filepath.Join(dir, "shard-0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(legacy) > 0 {
+		t.Fatalf("legacy files left: %v", legacy)
+	}
+	if again, err := Upgrade(dir); err != nil || len(again) > 0 {
+		t.Fatalf("second upgrade rewrote %v: %v", again, err)
+	}
+
+	skv, err := NewShardedKV(dir, 1, DefaultOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer skv.Close()
+	want := map[string]string{"a": "10", "d": "4", "e": "5"}
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		val, ok, err := skv.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w, live := want[key]; ok != live || string(val) != w {
+			t.Errorf("%s = %q, %v; want %q, %v", key, val, ok, w, live)
+		}
+	}
+}
@@ -0,0 +1,479 @@
+package keystore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/Aswin-Sk/MinionDB/internal/SSTables"
+	"github.com/Aswin-Sk/MinionDB/internal/fileformat"
+	"github.com/Aswin-Sk/MinionDB/internal/logger"
+)
+
+// A shard's WAL is a series of numbered segments, each a fileformat stamp
+// followed by records framed like manifest records,
+// [len u32][crc32c u32][payload]. The payload is the record's sequence
+// number and the time it was written, [seq u64][unix nanos i64], and a batch
+// of one or more ops, each [op u8][klen u32][vlen u32][key][value]. Sequence
+// numbers are shared by all shards and increase from record to record. A
+// record is replayed whole or not at all. A record opened by a prepare op is
+// one shard's part of a cross-shard batch and is only replayed once a commit
+// record, or the transaction log, says the batch committed.
+//
+// A crash can leave the last record incomplete or with a bad checksum. Under
+// SyncEveryBatch such a torn tail never holds an acknowledged write, since
+// writes are only acknowledged after the sync that follows them. Under
+// SyncInterval and NoSync, and for writes with WriteOptions.NoSync, writes
+// are acknowledged before the sync, so a torn tail can hold acknowledged
+// writes, which are then lost.
+//
+// The logs written before the manifest, active.wal and new.wal, hold bare
+// records without a delete's vlen. Upgrade converts them.
+const walRecordHeaderSize = 8
+
+// WALRecoveryMode decides how replay handles damaged WAL records.
+type WALRecoveryMode int
+
+const (
+	// WALTolerateTail truncates a torn record at the end of a log and
+	// fails on damage anywhere else. A damaged record is only taken for a
+	// torn tail if no intact record follows it.
+	WALTolerateTail WALRecoveryMode = iota
+	// WALStrict fails on any damaged record, including a torn tail.
+	WALStrict
+	// WALSkipCorrupted drops damaged records wherever they are and keeps
+	// the rest. Writes in the dropped records are lost.
+	WALSkipCorrupted
+)
+
+func (m WALRecoveryMode) String() string {
+	switch m {
+	case WALTolerateTail:
+		return "tolerate-tail"
+	case WALStrict:
+		return "strict"
+	case WALSkipCorrupted:
+		return "skip-corrupted"
+	default:
+		return fmt.Sprintf("WALRecoveryMode(%d)", int(m))
+	}
+}
+
+var (
+	walStamp = fileformat.Append(nil, fileformat.WALMagic, fileformat.WALVersion)
+
+	errTornRecord = errors.New("record extends past the end of the log")
+	errBadRecord  = errors.New("malformed record")
+)
+
+// batchOp is one write in a WAL record.
+type batchOp struct {
+	t   opType
+	key string
+	val []byte
+}
+
+// walRecord is a decoded WAL record.
+type walRecord struct {
+	seq uint64
+	// time is when the record was written, in Unix nanoseconds.
+	time int64
+	ops  []batchOp
+}
+
+func appendWALRecord(dst []byte, seq uint64, time int64, ops []batchOp) []byte {
+	start := len(dst)
+	dst = append(dst, make([]byte, walRecordHeaderSize)...)
+	dst = binary.LittleEndian.AppendUint64(dst, seq)
+	dst = binary.LittleEndian.AppendUint64(dst, uint64(time))
+	for _, op := range ops {
+		dst = append(dst, byte(op.t))
+		dst = binary.LittleEndian.AppendUint32(dst, uint32(len(op.key)))
+		dst = binary.LittleEndian.AppendUint32(dst, uint32(len(op.val)))
+		dst = append(dst, op.key...)
+		dst = append(dst, op.val...)
+	}
+	return frameRecord(dst, start)
+}
+
+// frameRecord fills in the record header reserved at dst[start:] for the
+// payload that follows it.
+func frameRecord(dst []byte, start int) []byte {
+	payload := dst[start+walRecordHeaderSize:]
+	binary.LittleEndian.PutUint32(dst[start:], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(dst[start+4:], crc32.Checksum(payload, castagnoli))
+	return dst
+}
+
+// decodeWALPayload decodes the payload of a WAL record.
+func decodeWALPayload(p []byte) (walRecord, error) {
+	var rec walRecord
+	if len(p) < 16 {
+		return rec, errBadRecord
+	}
+	rec.seq = binary.LittleEndian.Uint64(p)
+	rec.time = int64(binary.LittleEndian.Uint64(p[8:]))
+	p = p[16:]
+	var ops []batchOp
+	for len(p) > 0 {
+		if len(p) < 9 {
+			return rec, errBadRecord
+		}
+		op := opType(p[0])
+		klen := uint64(binary.LittleEndian.Uint32(p[1:5]))
+		vlen := uint64(binary.LittleEndian.Uint32(p[5:9]))
+		p = p[9:]
+		if op > opAbort || uint64(len(p)) < klen+vlen {
+			return rec, errBadRecord
+		}
+		if op >= opPrepare && (klen != 8 || vlen != 0 || len(ops) > 0) {
+			return rec, errBadRecord
+		}
+		ops = append(ops, batchOp{t: op, key: string(p[:klen]), val: p[klen : klen+vlen]})
+		p = p[klen+vlen:]
+	}
+	if len(ops) == 0 || (ops[0].t >= opCommit && len(ops) > 1) {
+		return rec, errBadRecord
+	}
+	rec.ops = ops
+	return rec, nil
+}
+
+// readWALRecord reads the next record from r, which has remaining bytes
+// left, and returns its payload and the number of bytes it spans. io.EOF
+// means the log ended cleanly.
+func readWALRecord(r io.Reader, remaining int64) ([]byte, int64, error) {
+	if remaining == 0 {
+		return nil, 0, io.EOF
+	}
+	var hdr [walRecordHeaderSize]byte
+	if remaining < walRecordHeaderSize {
+		return nil, remaining, errTornRecord
+	}
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, 0, err
+	}
+	n := int64(binary.LittleEndian.Uint32(hdr[0:4]))
+	span := walRecordHeaderSize + n
+	if span > remaining {
+		return nil, span, errTornRecord
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, 0, err
+	}
+	if crc32.Checksum(payload, castagnoli) != binary.LittleEndian.Uint32(hdr[4:8]) {
+		return nil, span, errors.New("record checksum mismatch")
+	}
+	return payload, span, nil
+}
+
+// afterDamage decides what follows a damaged record at off that spans span
+// bytes of a log of size bytes: the offset to carry on from, or whether the
+// record is a torn tail, after which nothing was written. A damaged length
+// can make any record seem to run to the end of the log, so such a record
+// is only taken for a torn tail if no intact record, one that valid accepts
+// and that passes its checksum, follows it.
+func afterDamage(f *os.File, off, span, size int64, valid func([]byte) bool) (int64, bool, error) {
+	if off+span < size {
+		return off + span, false, nil
+	}
+	buf := make([]byte, size-off-1)
+	if _, err := f.ReadAt(buf, off+1); err != nil {
+		return 0, false, err
+	}
+	for i := 0; i+walRecordHeaderSize <= len(buf); i++ {
+		n := int(binary.LittleEndian.Uint32(buf[i:]))
+		end := i + walRecordHeaderSize + n
+		if n == 0 || end > len(buf) {
+			continue
+		}
+		p := buf[i+walRecordHeaderSize : end]
+		if valid(p) && crc32.Checksum(p, castagnoli) == binary.LittleEndian.Uint32(buf[i+4:]) {
+			return off + 1 + int64(i), false, nil
+		}
+	}
+	return size, true, nil
+}
+
+// walReplay is the state built up by replaying a shard's WAL segments in
+// order.
+type walReplay struct {
+	mem map[string]SSTables.Entry
+	// pending holds the prepared parts of cross-shard batches, by
+	// transaction id, until a later record resolves them. The caller
+	// resolves whatever is left after the last segment.
+	pending map[uint64][]batchOp
+	// Records numbered up to flushed are already in tables and skipped, as
+	// are those numbered after until.
+	flushed uint64
+	until   uint64
+	lastSeq uint64
+}
+
+// ReplayWAL replays the segment at path into r. Damaged records are handled
+// according to mode; a torn tail that is tolerated is truncated so that
+// later appends follow the last good record.
+func ReplayWAL(path string, mode WALRecoveryMode, r *walReplay) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	version, err := readWALHeader(f)
+	if err != nil || version == 0 {
+		return err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	br := bufio.NewReader(f)
+	off := int64(fileformat.StampSize)
+	skipped := 0
+	for {
+		payload, span, err := readWALRecord(br, st.Size()-off)
+		if err == io.EOF {
+			break
+		}
+		if err == nil {
+			var rec walRecord
+			if rec, err = decodeWALPayload(payload); err == nil {
+				if rec.seq <= r.until {
+					if rec.seq == 0 || rec.seq > r.flushed {
+						applyOps(r.mem, resolve(r.pending, rec.ops))
+					}
+					r.lastSeq = max(r.lastSeq, rec.seq)
+				}
+				off += span
+				continue
+			}
+		}
+		if span == 0 {
+			// A read error rather than damage.
+			return err
+		}
+
+		next, tail, rerr := afterDamage(f, off, span, st.Size(), func(p []byte) bool {
+			_, err := decodeWALPayload(p)
+			return err == nil
+		})
+		if rerr != nil {
+			return rerr
+		}
+		if mode == WALStrict || (mode == WALTolerateTail && !tail) {
+			return &SSTables.CorruptionError{Path: path, Offset: off, Reason: err.Error()}
+		}
+		if tail {
+			logger.Logger.Warn("truncating torn WAL tail", "path", path, "offset", off, "error", err)
+			if err := f.Truncate(off); err != nil {
+				return err
+			}
+			if err := f.Sync(); err != nil {
+				return err
+			}
+			break
+		}
+		skipped++
+		off = next
+		if _, err := f.Seek(off, io.SeekStart); err != nil {
+			return err
+		}
+		br.Reset(f)
+	}
+	if skipped > 0 {
+		logger.Logger.Warn("skipped corrupted WAL records", "path", path, "count", skipped)
+	}
+	return nil
+}
+
+// resolve returns the writes that take effect with a record of ops. The
+// prepared parts of cross-shard batches wait in pending, by transaction id,
+// for the record that resolves them.
+func resolve(pending map[uint64][]batchOp, ops []batchOp) []batchOp {
+	switch ops[0].t {
+	case opPrepare:
+		pending[txnID(ops[0].key)] = ops[1:]
+		return nil
+	case opCommit:
+		id := txnID(ops[0].key)
+		committed := pending[id]
+		delete(pending, id)
+		return committed
+	case opAbort:
+		delete(pending, txnID(ops[0].key))
+		return nil
+	default:
+		return ops
+	}
+}
+
+// walReader reads the records of a segment in order, for readers other than
+// recovery. It stops quietly at the end of what has been written, including
+// at a record still being appended, and with an error at damage elsewhere.
+type walReader struct {
+	f       *os.File
+	br      *bufio.Reader
+	version uint32
+	off     int64
+	size    int64
+	rec     walRecord
+	err     error
+}
+
+func openWALReader(path string) (*walReader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	version, err := readWALHeader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &walReader{f: f, br: bufio.NewReader(f), version: version, off: fileformat.StampSize, size: st.Size()}, nil
+}
+
+func (r *walReader) next() bool {
+	if r.version == 0 || r.err != nil {
+		return false
+	}
+	payload, span, err := readWALRecord(r.br, r.size-r.off)
+	if err == io.EOF {
+		return false
+	}
+	if err == nil {
+		r.rec, err = decodeWALPayload(payload)
+	}
+	if err != nil {
+		if span != 0 && r.off+span < r.size {
+			r.err = &SSTables.CorruptionError{Path: r.f.Name(), Offset: r.off, Reason: err.Error()}
+		} else if span == 0 {
+			r.err = err
+		}
+		return false
+	}
+	r.off += span
+	return true
+}
+
+func (r *walReader) close() error {
+	return r.f.Close()
+}
+
+// lastSeqOf returns the sequence number of the last record in the segment at
+// path.
+func lastSeqOf(path string) (uint64, error) {
+	r, err := openWALReader(path)
+	if err != nil {
+		return 0, err
+	}
+	defer r.close()
+	var last uint64
+	for r.next() {
+		last = r.rec.seq
+	}
+	return last, r.err
+}
+
+// txnKey and txnID convert a transaction id to and from the key of the op
+// that carries it.
+func txnKey(id uint64) string {
+	return string(binary.LittleEndian.AppendUint64(nil, id))
+}
+
+func txnID(key string) uint64 {
+	return binary.LittleEndian.Uint64([]byte(key))
+}
+
+// applyOps applies ops, in order, to the memtable mem.
+func applyOps(mem map[string]SSTables.Entry, ops []batchOp) {
+	for _, op := range ops {
+		if op.t == opSet {
+			mem[op.key] = SSTables.Entry{Kind: SSTables.KindPut, Value: op.val}
+		} else {
+			mem[op.key] = SSTables.Entry{Kind: SSTables.KindDelete}
+		}
+	}
+}
+
+// initWAL stamps a new WAL segment, or one whose stamp was torn by a crash
+// while it was being created, and returns its size. Records are appended
+// after the stamp.
+func initWAL(f *os.File) (int64, error) {
+	version, err := readWALHeader(f)
+	if err != nil {
+		return 0, err
+	}
+	if version != 0 {
+		st, err := f.Stat()
+		if err != nil {
+			return 0, err
+		}
+		return st.Size(), nil
+	}
+	if err := f.Truncate(0); err != nil {
+		return 0, err
+	}
+	if _, err := f.Write(walStamp); err != nil {
+		return 0, err
+	}
+	return int64(len(walStamp)), f.Sync()
+}
+
+// readWALHeader consumes the stamp at the start of f and returns its
+// version. It returns zero for an empty log, including one holding only part
+// of a stamp.
+func readWALHeader(f *os.File) (uint32, error) {
+	var hdr [fileformat.StampSize]byte
+	n, err := io.ReadFull(f, hdr[:])
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return 0, err
+	}
+	if n < len(hdr) && strings.HasPrefix(string(walStamp), string(hdr[:n])) {
+		return 0, nil
+	}
+	if err := fileformat.Check(f.Name(), hdr[:n], fileformat.WALMagic, fileformat.WALVersion, false); err != nil {
+		return 0, err
+	}
+	return fileformat.Version(hdr[:]), nil
+}
+
+// isLegacyOp reports whether b is the op byte of a legacy log record.
+func isLegacyOp(b byte) bool {
+	return b == byte(opSet) || b == byte(opDel)
+}
+
+// decodeLegacyWALRecord decodes one unframed record,
+// [op u8][klen u32][vlen u32, sets only][key][value].
+func decodeLegacyWALRecord(b []byte) (opType, string, []byte, []byte, bool) {
+	if len(b) < 5 || !isLegacyOp(b[0]) {
+		return 0, "", nil, nil, false
+	}
+	op := opType(b[0])
+	klen := uint64(binary.LittleEndian.Uint32(b[1:5]))
+	b = b[5:]
+	var vlen uint64
+	if op == opSet {
+		if len(b) < 4 {
+			return 0, "", nil, nil, false
+		}
+		vlen = uint64(binary.LittleEndian.Uint32(b))
+		b = b[4:]
+	}
+	if uint64(len(b)) < klen+vlen {
+		return 0, "", nil, nil, false
+	}
+	return op, string(b[:klen]), b[klen : klen+vlen], b[klen+vlen:], true
+}
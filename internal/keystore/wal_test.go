@@ -0,0 +1,249 @@
+package keystore
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Aswin-Sk/MinionDB/internal/SSTables"
+	"github.com/Aswin-Sk/MinionDB/internal/fileformat"
+)
+
+const testRecords = 10
+
+// writeTestWAL writes a segment holding testRecords records, each setting
+// its own key, and returns its path and the offset of each record.
+func writeTestWAL(t *testing.T) (string, []int64) {
+	t.Helper()
+	buf := append([]byte(nil), walStamp...)
+	var offs []int64
+	for i := range testRecords {
+		offs = append(offs, int64(len(buf)))
+		ops := []batchOp{{t: opSet, key: fmt.Sprintf("key-%02d", i), val: []byte("value")}}
+		buf = appendWALRecord(buf, uint64(i+1), int64(i+1), ops)
+	}
+	path := filepath.Join(t.TempDir(), "000001.wal")
+	if err := os.WriteFile(path, buf, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path, offs
+}
+
+func replayTestWAL(path string, mode WALRecoveryMode) (*walReplay, error) {
+	r := &walReplay{
+		mem:     make(map[string]SSTables.Entry),
+		pending: make(map[uint64][]batchOp),
+		until:   ^uint64(0),
+	}
+	return r, ReplayWAL(path, mode, r)
+}
+
+// damage breaks the log at path at the record starting at off.
+type damage func(t *testing.T, path string, off int64)
+
+// tearTail cuts the log short halfway through its last record.
+func tearTail(t *testing.T, path string, off int64) {
+	st, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(path, off+(st.Size()-off)/2); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// patch overwrites the log at path from off with b.
+func patch(t *testing.T, path string, off int64, b []byte) {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteAt(b, off); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// growLength makes the record's length run past the end of the log.
+func growLength(t *testing.T, path string, off int64) {
+	patch(t, path, off, binary.LittleEndian.AppendUint32(nil, 1<<20))
+}
+
+// flipPayload changes a byte of the record's payload.
+func flipPayload(t *testing.T, path string, off int64) {
+	patch(t, path, off+walRecordHeaderSize+2, []byte{0xff})
+}
+
+func TestReplayWALDamage(t *testing.T) {
+	tests := []struct {
+		name   string
+		damage damage
+		tail   bool
+	}{
+		{"torn tail", tearTail, true},
+		{"mid-log length", growLength, false},
+		{"mid-log payload", flipPayload, false},
+	}
+	for _, tt := range tests {
+		for _, mode := range []WALRecoveryMode{WALTolerateTail, WALStrict, WALSkipCorrupted} {
+			t.Run(fmt.Sprintf("%s/%s", tt.name, mode), func(t *testing.T) {
+				path, offs := writeTestWAL(t)
+				broken := 3
+				if tt.tail {
+					broken = testRecords - 1
+				}
+				tt.damage(t, path, offs[broken])
+				before, err := os.Stat(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				r, err := replayTestWAL(path, mode)
+				if mode == WALStrict || (mode == WALTolerateTail && !tt.tail) {
+					var ce *SSTables.CorruptionError
+					if !errors.As(err, &ce) || ce.Offset != offs[broken] {
+						t.Fatalf("got %v, want corruption at offset %d", err, offs[broken])
+					}
+					after, err := os.Stat(path)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if after.Size() != before.Size() {
+						t.Fatalf("log changed from %d to %d bytes", before.Size(), after.Size())
+					}
+					return
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(r.mem) != testRecords-1 {
+					t.Fatalf("replayed %d keys, want %d", len(r.mem), testRecords-1)
+				}
+				for i := range testRecords {
+					_, ok := r.mem[fmt.Sprintf("key-%02d", i)]
+					if ok == (i == broken) {
+						t.Errorf("key-%02d replayed: %v", i, ok)
+					}
+				}
+				if tt.tail {
+					after, err := os.Stat(path)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if after.Size() != offs[broken] {
+						t.Fatalf("log is %d bytes, want truncated to %d", after.Size(), offs[broken])
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestReadTxnLogDamage(t *testing.T) {
+	for _, mode := range []WALRecoveryMode{WALTolerateTail, WALStrict, WALSkipCorrupted} {
+		t.Run(mode.String(), func(t *testing.T) {
+			base := t.TempDir()
+			l, err := createTxnLog(base)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for id := uint64(1); id <= testRecords; id++ {
+				if err := l.commit(id); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := l.close(); err != nil {
+				t.Fatal(err)
+			}
+			// Each commit record spans a header and an 8-byte id.
+			growLength(t, txnLogFileName(base), int64(fileformat.StampSize)+3*(walRecordHeaderSize+8))
+
+			committed, err := readTxnLog(base, mode)
+			if mode != WALSkipCorrupted {
+				var ce *SSTables.CorruptionError
+				if !errors.As(err, &ce) {
+					t.Fatalf("got %v, want a corruption error", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(committed) != testRecords-1 || committed[4] {
+				t.Fatalf("committed %v, want every id but 4", committed)
+			}
+		})
+	}
+}
+
+func TestWALSegmentsRotateAndTrim(t *testing.T) {
+	dir := t.TempDir()
+	opts := DefaultOptions()
+	opts.WALSegmentSize = 512
+	opts.WALBatchSize = 1
+	skv, err := NewShardedKV(dir, 1, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := skv.shards[0]
+	set := func(from, to int) {
+		for i := from; i < to; i++ {
+			if err := skv.Set(fmt.Sprintf("k%03d", i), []byte(fmt.Sprint(i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	set(0, 50)
+	nums, err := liveWALs(db.baseDirectory, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nums) < 3 {
+		t.Fatalf("%d segments, want the log split over several", len(nums))
+	}
+	// Record numbers rise from segment to segment.
+	var prev uint64
+	for _, num := range nums[:len(nums)-1] {
+		last, err := lastSeqOf(walFileName(db.baseDirectory, num))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if last <= prev {
+			t.Fatalf("segment %d ends at seq %d, after %d", num, last, prev)
+		}
+		prev = last
+	}
+
+	if err := db.flushMemtable(); err != nil {
+		t.Fatal(err)
+	}
+	v := db.manifest.current()
+	if v.flushedSeq != skv.seq.Load() {
+		t.Fatalf("manifest flushed seq %d, want %d", v.flushedSeq, skv.seq.Load())
+	}
+	left, err := liveWALs(db.baseDirectory, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(left) != 1 || left[0] < v.logNum {
+		t.Fatalf("segments %v left after flush, want only the one from %d", left, v.logNum)
+	}
+
+	// Replay after a crash starts from the flushed point.
+	set(50, 60)
+	crash(t, skv)
+	skv, err = NewShardedKV(dir, 1, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer skv.Close()
+	for i := range 60 {
+		key := fmt.Sprintf("k%03d", i)
+		if val, ok, err := skv.Get(key); err != nil || !ok || string(val) != fmt.Sprint(i) {
+			t.Fatalf("%s = %q, %v, %v; want %d", key, val, ok, err, i)
+		}
+	}
+}
@@ -1,22 +1,41 @@
 package app
 
 import (
+	"context"
+	"errors"
 	"net/http"
+	"time"
 
 	"github.com/Aswin-Sk/MinionDB/internal/keystore"
-
 	"github.com/gin-gonic/gin"
 )
 
+// requestTimeout bounds how long a handler waits on the store.
+const requestTimeout = 5 * time.Second
+
+// errorStatus maps a store error to a response status, or to fallback if it
+// is none of the store's transient conditions.
+func errorStatus(err error, fallback int) int {
+	switch {
+	case errors.Is(err, keystore.ErrDegraded), errors.Is(err, keystore.ErrBusy):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout
+	default:
+		return fallback
+	}
+}
+
 func handleGet(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), requestTimeout)
+	defer cancel()
 	key := c.Param("key")
-	val, err := db.Get(key)
-	if !err {
-		c.JSON(http.StatusNotFound, gin.H{"error": "key not found"})
+	val, ok, err := db.GetCtx(ctx, key)
+	if err != nil {
+		c.JSON(errorStatus(err, http.StatusInternalServerError), gin.H{"error": err.Error()})
 		return
 	}
-	valString := string(val)
-	if valString == keystore.Tombstone {
+	if !ok {
 		c.JSON(http.StatusNotFound, gin.H{"error": "key not found"})
 		return
 	}
@@ -35,16 +54,24 @@ func handleSet(c *gin.Context) {
 		return
 	}
 
-	if err := db.Set(req.Key, []byte(req.Value)); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	ctx, cancel := context.WithTimeout(c.Request.Context(), requestTimeout)
+	defer cancel()
+	if err := db.SetCtx(ctx, req.Key, []byte(req.Value)); err != nil {
+		c.JSON(errorStatus(err, http.StatusInternalServerError), gin.H{"error": err.Error()})
 		return
 	}
 	c.JSON(http.StatusOK, gin.H{"status": "ok"})
 }
 
 func handleDelete(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), requestTimeout)
+	defer cancel()
 	key := c.Param("key")
-	if err := db.Delete(key); err != nil {
+	if err := db.DeleteCtx(ctx, key); err != nil {
+		if status := errorStatus(err, 0); status != 0 {
+			c.JSON(status, gin.H{"error": err.Error()})
+			return
+		}
 		c.JSON(http.StatusNotFound, gin.H{"error": "key not found"})
 		return
 	}
@@ -22,7 +22,7 @@ func Start() {
 	logger.InitLogger(slog.LevelInfo)
 
 	var err error
-	db, err = keystore.NewShardedKV(path, 16)
+	db, err = keystore.NewShardedKV(path, 16, keystore.DefaultOptions())
 	if err != nil {
 		panic(err)
 	}